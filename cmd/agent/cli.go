@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"cmder/internal/api"
+	"cmder/internal/config"
+)
+
+// usage 命令行帮助
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, `用法: cmd-agent [-config 配置文件] [子命令]
+
+子命令:
+  serve           启动服务(默认)
+  check-config    检查配置文件, 包括引用的证书和密钥
+  print-defaults  输出各配置项的默认值
+
+选项:`)
+	flag.PrintDefaults()
+}
+
+// checkConfig 加载并验证配置, 有问题时逐条输出并返回非0
+func checkConfig() int {
+	c, err := config.LoadAgent()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := api.CheckAgent(c); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("配置检查通过:", config.AgentFile)
+	return 0
+}
+
+// printDefaults 以yaml格式输出默认配置
+func printDefaults() int {
+	c, err := config.Defaults[config.Agent]()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
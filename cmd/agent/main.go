@@ -1,60 +1,171 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"cmder/internal/api"
 	"cmder/internal/config"
+	"cmder/internal/logging"
+	"cmder/internal/metrics"
+	"cmder/internal/version"
 )
 
 func main() {
+	flag.StringVar(&config.AgentFile, "config", "./config.yaml", "配置文件路径")
+	showVersion := flag.Bool("version", false, "显示版本信息")
+	flag.Usage = usage
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(version.String("cmd-agent"))
+		return
+	}
+	// 子命令, 默认启动服务
+	cmd := "serve"
+	if flag.NArg() > 0 {
+		cmd = flag.Arg(0)
+	}
+	switch cmd {
+	case "serve":
+		os.Exit(serve())
+	case "check-config":
+		os.Exit(checkConfig())
+	case "print-defaults":
+		os.Exit(printDefaults())
+	default:
+		fmt.Fprintln(os.Stderr, "未知的子命令:", cmd)
+		usage()
+		os.Exit(2)
+	}
+}
+
+// serve 启动服务, 返回进程退出码
+func serve() int {
+	if _, err := config.LoadAgent(); err != nil {
+		slog.Error("加载配置失败", slog.String("File", config.AgentFile), slog.String("Error", err.Error()))
+		return 1
+	}
+	if err := logging.Setup(config.GetAgent().GetLog()); err != nil {
+		slog.Error("初始化日志失败", slog.String("Error", err.Error()))
+		return 1
+	}
+	defer logging.Close()
 	mux := http.NewServeMux()
-	agentC := config.GetAgent()
-	addCmd := api.Key(agentC, api.IpCheck(agentC, api.AddCmd))
-	outCmd := api.Key(agentC, api.IpCheck(agentC, api.OutCmd))
-	script := api.Key(agentC, api.IpCheck(agentC, api.RunScriptWS))
-	listTask := api.Key(agentC, api.IpCheck(agentC, api.ListTask))
+	// 中间件每次请求读取当前配置, 重新加载后立即生效
+	agentC := config.CurrentAgent
+	// 审计日志
+	if err := api.InitAudit(agentC, "agent"); err != nil {
+		slog.Error("初始化审计日志失败", slog.String("Error", err.Error()))
+		return 1
+	}
+	defer api.CloseAudit()
+	if err := api.InitTrustedProxies(agentC); err != nil {
+		slog.Error("解析trustedProxies失败", slog.String("Error", err.Error()))
+		return 1
+	}
+	if err := api.InitBan(agentC); err != nil {
+		slog.Error("初始化封禁失败", slog.String("Error", err.Error()))
+		return 1
+	}
+	// 接管重启前仍在运行的任务
+	if err := api.RecoverTasks(); err != nil {
+		slog.Error("恢复任务失败", slog.String("Error", err.Error()))
+		return 1
+	}
+	addCmd := api.IpCheck(agentC, api.Key(agentC, api.RateLimit(agentC, api.AddCmd)))
+	outCmd := api.IpCheck(agentC, api.Key(agentC, api.RateLimit(agentC, api.OutCmd)))
+	script := api.IpCheck(agentC, api.Key(agentC, api.RateLimit(agentC, api.RunScriptWS)))
+	listTask := api.IpCheck(agentC, api.Key(agentC, api.RateLimit(agentC, api.ListTask)))
 	mux.HandleFunc("POST /api/cmd/add", addCmd)
 	mux.HandleFunc("GET /api/cmd/out", outCmd)
 	mux.HandleFunc("GET /api/cmd/runws", script)
 	mux.HandleFunc("GET /api/cmd/ids", listTask)
-	// 资源占用情况调试
-	// go func() {
-	// 	for {
-	// 		fmt.Println("当前协程数量：", runtime.NumGoroutine())
-	// 		time.Sleep(5 * time.Second)
-	// 	}
-
-	// }()
+	// 封禁管理, 经proxy转发(仅管理员)
+	mux.HandleFunc("GET /api/cmd/bans", api.IpCheck(agentC, api.Key(agentC, api.RateLimit(agentC, api.ListBans))))
+	mux.HandleFunc("DELETE /api/cmd/bans", api.IpCheck(agentC, api.Key(agentC, api.RateLimit(agentC, api.LiftBan))))
+	// 监控指标(Prometheus), 只校验白名单
+	api.RegisterAgentMetrics()
+	mux.HandleFunc("GET /metrics", api.IpCheck(agentC, metrics.Handler))
 	server := http.Server{
 		Addr:         config.GetAgent().Addr,
-		Handler:      mux,
+		Handler:      api.RequestLog(mux),
 		ReadTimeout:  config.GetAgent().ReadTimeout,
 		WriteTimeout: config.GetAgent().WriteTimeout,
 	}
+	tlsConf, err := api.ServerTLSConfig(config.GetAgent().TLS)
+	if err != nil {
+		slog.Error("加载TLS配置失败", slog.String("Error", err.Error()))
+		return 1
+	}
+	server.TLSConfig = tlsConf
 
 	start := make(chan error, 1)
 	quit := make(chan os.Signal, 1)
 
 	// 协程启动服务
 	go func() {
-		slog.Info("Agent启动...", slog.String("Addr", config.GetAgent().Addr))
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Info("Agent启动...", slog.String("Addr", config.GetAgent().Addr), slog.Bool("TLS", tlsConf != nil))
+		if err := api.ListenAndServe(&server); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			start <- err
 		}
 	}()
+	// 配置文件修改或收到SIGHUP时重新加载配置
+	reload := make(chan os.Signal, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go config.Watch(config.AgentFile, 2*time.Second, stop, func() {
+		select {
+		case reload <- syscall.SIGHUP:
+		default:
+		}
+	})
+	signal.Notify(reload, syscall.SIGHUP)
 	// 监听失败和退出信号
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	select {
-	case err := <-start:
-		slog.Error("Agent启动失败", slog.String("Error", err.Error()))
-	case sig := <-quit:
-		slog.Info("Agent关闭,并清理资源", slog.String("Signal", sig.String()))
+	for {
+		select {
+		case err := <-start:
+			slog.Error("Agent启动失败", slog.String("Error", err.Error()))
+			return 1
+		case <-reload:
+			if err := api.ReloadAgent(); err != nil {
+				slog.Error("重新加载配置失败, 继续使用原配置", slog.String("Error", err.Error()))
+			}
+		case sig := <-quit:
+			drain := config.GetAgent().DrainTimeout
+			slog.Info("Agent关闭, 不再接受新任务", slog.String("Signal", sig.String()), slog.Duration("DrainTimeout", drain))
+			ctx, cancel := drainContext(quit, drain)
+			api.DrainAgent(ctx)
+			cancel()
+			// 任务已结束, 关闭服务
+			ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+			api.ShutdownServer(ctx, &server)
+			cancel()
+			slog.Info("Agent已关闭")
+			return 0
+		}
 	}
 }
+
+// drainContext 等待任务结束的上下文, 超时或再次收到退出信号时结束
+func drainContext(quit <-chan os.Signal, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	go func() {
+		select {
+		case sig := <-quit:
+			slog.Warn("再次收到退出信号, 不再等待", slog.String("Signal", sig.String()))
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"cmder/internal/api"
+	"cmder/internal/config"
+)
+
+// usage 命令行帮助
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, `用法: cmd-proxy [-config 配置文件] [子命令] [参数]
+
+子命令:
+  serve           启动服务(默认)
+  check-config    检查配置文件, 包括引用的证书、密钥和用户文件
+  print-defaults  输出各配置项的默认值
+  verify-audit    校验审计日志的哈希链和签名
+  hash-password   从标准输入读取密码, 输出bcrypt哈希
+  keygen          生成请求签名的ed25519密钥
+
+选项:`)
+	flag.PrintDefaults()
+}
+
+// checkConfig 加载并验证配置, 有问题时逐条输出并返回非0
+func checkConfig() int {
+	c, err := config.LoadProxy()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := api.CheckProxy(c); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("配置检查通过:", config.ProxyFile)
+	return 0
+}
+
+// printDefaults 以yaml格式输出默认配置
+func printDefaults() int {
+	c, err := config.Defaults[config.Proxy]()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+
+	"cmder/internal/api"
+)
+
+// keygen 生成proxy的ed25519签名私钥, 并输出需要配置到agent的公钥
+//
+//	cmd-proxy keygen [-out proxy.key]
+func keygen(args []string) int {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", "./proxy.key", "私钥文件, 已存在时不会覆盖")
+	_ = fs.Parse(args)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "生成密钥失败:", err)
+		return 2
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "编码私钥失败:", err)
+		return 2
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "创建私钥文件失败:", err)
+		return 2
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		_ = f.Close()
+		fmt.Fprintln(os.Stderr, "写入私钥失败:", err)
+		return 2
+	}
+	if err := f.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, "写入私钥失败:", err)
+		return 2
+	}
+	fmt.Printf("私钥已写入 %s, 在proxy配置中设置 privateKey: %s\n", *out, *out)
+	fmt.Printf("公钥标识: %s\n", api.KeyId(pub))
+	fmt.Println("在agent配置中添加:")
+	fmt.Println("proxyKeys:")
+	fmt.Println("  - name: proxy")
+	fmt.Printf("    publicKey: %s\n", base64.StdEncoding.EncodeToString(pub))
+	return 0
+}
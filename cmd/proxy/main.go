@@ -1,24 +1,79 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+	_ "time/tzdata" // 嵌入时区数据, 保证 access.timeZone 在没有时区文件的主机上可用
 
 	"cmder/internal/api"
 	"cmder/internal/config"
+	"cmder/internal/logging"
+	"cmder/internal/metrics"
+	"cmder/internal/version"
 )
 
 //go:embed web/index.html
 var indexHTML string
 
+//go:embed web/login.html
+var loginHTML string
+
 func main() {
+	flag.StringVar(&config.ProxyFile, "config", "./config.yaml", "配置文件路径")
+	showVersion := flag.Bool("version", false, "显示版本信息")
+	flag.Usage = usage
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(version.String("cmd-proxy"))
+		return
+	}
+	// 子命令, 默认启动服务
+	cmd, args := "serve", []string{}
+	if flag.NArg() > 0 {
+		cmd, args = flag.Arg(0), flag.Args()[1:]
+	}
+	switch cmd {
+	case "serve":
+		os.Exit(serve())
+	case "check-config":
+		os.Exit(checkConfig())
+	case "print-defaults":
+		os.Exit(printDefaults())
+	case "verify-audit":
+		os.Exit(verifyAudit(args))
+	case "hash-password":
+		os.Exit(hashPassword())
+	case "keygen":
+		os.Exit(keygen(args))
+	default:
+		fmt.Fprintln(os.Stderr, "未知的子命令:", cmd)
+		usage()
+		os.Exit(2)
+	}
+}
+
+// serve 启动服务, 返回进程退出码
+func serve() int {
+	if _, err := config.LoadProxy(); err != nil {
+		slog.Error("加载配置失败", slog.String("File", config.ProxyFile), slog.String("Error", err.Error()))
+		return 1
+	}
+	if err := logging.Setup(config.GetProxy().GetLog()); err != nil {
+		slog.Error("初始化日志失败", slog.String("Error", err.Error()))
+		return 1
+	}
+	defer logging.Close()
 	// 嵌入html文件
-	api.InitWebContent(indexHTML)
+	api.InitWebContent(indexHTML, loginHTML)
 	mux := http.NewServeMux()
 	// 这里填写的"/api/cmd/" 是agent端的上层路由
 	// agent中路由如下:
@@ -27,36 +82,141 @@ func main() {
 	//     /api/cmd/ids
 	//     /api/cmd/runws
 
-	proxyC := config.GetProxy()
-	index := api.TimeRestricted(proxyC, api.IpCheck(proxyC, api.Index))
-	forword := api.TimeRestricted(proxyC, api.IpCheck(proxyC, api.Forward))
-	targets := api.TimeRestricted(proxyC, api.IpCheck(proxyC, api.Targets))
-	mux.HandleFunc("/", index)
-	mux.HandleFunc("/api/targets", targets)
-	mux.HandleFunc("/api/cmd/", forword)
+	// 中间件每次请求读取当前配置, 重新加载后立即生效
+	proxyC := config.CurrentProxy
+	// 审计日志
+	if err := api.InitAudit(proxyC, "proxy"); err != nil {
+		slog.Error("初始化审计日志失败", slog.String("Error", err.Error()))
+		return 1
+	}
+	defer api.CloseAudit()
+	if err := api.InitTrustedProxies(proxyC); err != nil {
+		slog.Error("解析trustedProxies失败", slog.String("Error", err.Error()))
+		return 1
+	}
+	if err := api.InitBan(proxyC); err != nil {
+		slog.Error("初始化封禁失败", slog.String("Error", err.Error()))
+		return 1
+	}
+	if err := api.InitBreakGlass(proxyC); err != nil {
+		slog.Error("初始化紧急访问失败", slog.String("Error", err.Error()))
+		return 1
+	}
+	// authed ip白名单 -> 登录 -> 限流, 不受访问时间限制(登录后才能申请紧急访问)
+	authed := func(next http.HandlerFunc) http.HandlerFunc {
+		return api.IpCheck(proxyC, api.Login(api.RateLimit(proxyC, next)))
+	}
+	// guard ip白名单 -> 登录 -> 时间段(紧急访问中不限制) -> 限流
+	guard := func(next http.HandlerFunc) http.HandlerFunc {
+		return authed(api.TimeRestricted(proxyC, next))
+	}
+	// 转发接口和执行脚本按命令类别检查访问时间和变更窗口(只读命令始终允许),
+	// 控制台页面和主机列表用于执行这些命令, 同样不在这里限制
+	mux.HandleFunc("/", authed(api.Index))
+	mux.HandleFunc("/api/targets", authed(api.Targets))
+	// 转发接口在Forward中校验target后再限流
+	mux.HandleFunc("/api/cmd/", api.IpCheck(proxyC, api.Login(api.Forward)))
+	mux.HandleFunc("GET /api/audit", guard(api.QueryAudit))
+	// 监控指标(Prometheus), 只校验白名单
+	api.RegisterProxyMetrics()
+	mux.HandleFunc("GET /metrics", api.IpCheck(proxyC, metrics.Handler))
+	mux.HandleFunc("GET /api/bans", guard(api.AdminOnly(api.ListBans)))
+	mux.HandleFunc("DELETE /api/bans", guard(api.AdminOnly(api.LiftBan)))
+	// 登录
+	mux.HandleFunc("GET /login", api.IpCheck(proxyC, api.LoginPage))
+	mux.HandleFunc("POST /api/login", api.IpCheck(proxyC, api.RateLimit(proxyC, api.DoLogin)))
+	mux.HandleFunc("POST /api/logout", api.IpCheck(proxyC, api.Logout))
+	mux.HandleFunc("GET /api/me", authed(api.Me))
+	// 紧急访问
+	mux.HandleFunc("GET /api/breakglass", authed(api.ListBreakGlass))
+	mux.HandleFunc("POST /api/breakglass", authed(api.RequestBreakGlass))
+	mux.HandleFunc("DELETE /api/breakglass/{id}", authed(api.EndBreakGlass))
+	mux.HandleFunc("POST /api/breakglass/{id}/ack", authed(api.AckBreakGlass))
+	// API令牌
+	mux.HandleFunc("GET /api/tokens", guard(api.ListTokens))
+	mux.HandleFunc("POST /api/tokens", guard(api.CreateToken))
+	mux.HandleFunc("DELETE /api/tokens/{id}", guard(api.RevokeToken))
+	// 脚本库
+	mux.HandleFunc("GET /api/scripts", guard(api.ListScripts))
+	mux.HandleFunc("POST /api/scripts", guard(api.AdminOnly(api.SaveScript)))
+	mux.HandleFunc("GET /api/scripts/{name}", guard(api.GetScript))
+	mux.HandleFunc("POST /api/scripts/{name}", guard(api.AdminOnly(api.SaveScript)))
+	mux.HandleFunc("DELETE /api/scripts/{name}", guard(api.AdminOnly(api.DeleteScript)))
+	mux.HandleFunc("POST /api/scripts/{name}/run", authed(api.RunScript))
 	server := http.Server{
 		Addr:         config.GetProxy().Addr,
-		Handler:      mux,
+		Handler:      api.RequestLog(mux),
 		ReadTimeout:  config.GetProxy().ReadTimeout,
 		WriteTimeout: config.GetProxy().WriteTimeout,
 	}
+	tlsConf, err := api.ServerTLSConfig(config.GetProxy().TLS)
+	if err != nil {
+		slog.Error("加载TLS配置失败", slog.String("Error", err.Error()))
+		return 1
+	}
+	server.TLSConfig = tlsConf
 
 	start := make(chan error, 1)
 	quit := make(chan os.Signal, 1)
 
 	// 协程启动服务
 	go func() {
-		slog.Info("Proxy启动...", slog.String("Addr", config.GetProxy().Addr))
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Info("Proxy启动...", slog.String("Addr", config.GetProxy().Addr), slog.Bool("TLS", tlsConf != nil))
+		if err := api.ListenAndServe(&server); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			start <- err
 		}
 	}()
+	// 配置文件修改或收到SIGHUP时重新加载配置
+	reload := make(chan os.Signal, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go config.Watch(config.ProxyFile, 2*time.Second, stop, func() {
+		select {
+		case reload <- syscall.SIGHUP:
+		default:
+		}
+	})
+	signal.Notify(reload, syscall.SIGHUP)
 	// 监听失败和退出信号
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	select {
-	case err := <-start:
-		slog.Error("Proxy启动失败", slog.String("Error", err.Error()))
-	case sig := <-quit:
-		slog.Info("Proxy关闭,并清理资源", slog.String("Signal", sig.String()))
+	for {
+		select {
+		case err := <-start:
+			slog.Error("Proxy启动失败", slog.String("Error", err.Error()))
+			return 1
+		case <-reload:
+			if err := api.ReloadProxy(); err != nil {
+				slog.Error("重新加载配置失败, 继续使用原配置", slog.String("Error", err.Error()))
+			}
+		case sig := <-quit:
+			drain := config.GetProxy().DrainTimeout
+			slog.Info("Proxy关闭, 停止监听", slog.String("Signal", sig.String()), slog.Duration("DrainTimeout", drain))
+			ctx, cancel := drainContext(quit, drain)
+			// 停止监听并等待http请求结束, 同时通知websocket客户端
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				api.ShutdownServer(ctx, &server)
+			}()
+			api.DrainProxy(ctx)
+			<-done
+			cancel()
+			slog.Info("Proxy已关闭")
+			return 0
+		}
 	}
 }
+
+// drainContext 等待任务结束的上下文, 超时或再次收到退出信号时结束
+func drainContext(quit <-chan os.Signal, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	go func() {
+		select {
+		case sig := <-quit:
+			slog.Warn("再次收到退出信号, 不再等待", slog.String("Signal", sig.String()))
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
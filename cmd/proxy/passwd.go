@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"cmder/internal/api"
+)
+
+// hashPassword 从标准输入读取密码, 输出用于用户文件的bcrypt哈希
+//
+//	echo -n 'password' | cmd-proxy hash-password
+func hashPassword() int {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintln(os.Stderr, "读取密码失败:", err)
+		return 2
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "密码不能为空")
+		return 2
+	}
+	hash, err := api.HashPassword(password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "生成密码哈希失败:", err)
+		return 2
+	}
+	fmt.Println(hash)
+	return 0
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"os"
+
+	"cmder/internal/audit"
+	"cmder/internal/config"
+)
+
+// verifyAudit 校验审计文件的哈希链和签名, 发现问题时返回非0
+//
+//	cmd-proxy verify-audit [-pub 公钥文件] [审计文件...]
+func verifyAudit(args []string) int {
+	fs := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	pubFile := fs.String("pub", "", "ed25519公钥(或私钥)文件, 默认使用配置中的 audit.signKey")
+	_ = fs.Parse(args)
+
+	files := fs.Args()
+	if len(files) == 0 || *pubFile == "" {
+		cfg := config.GetProxy().GetAudit()
+		if len(files) == 0 {
+			var err error
+			if files, err = audit.FilesOf(cfg.File); err != nil {
+				fmt.Fprintln(os.Stderr, "查找审计文件失败:", err)
+				return 2
+			}
+		}
+		if *pubFile == "" {
+			*pubFile = cfg.SignKey
+		}
+	}
+	var pub ed25519.PublicKey
+	if *pubFile != "" {
+		var err error
+		if pub, err = audit.LoadPublicKey(*pubFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	report, err := audit.Verify(files, pub)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "校验失败:", err)
+		return 2
+	}
+	fmt.Printf("文件数: %d, 记录数: %d, 序号: %d-%d, 签名数: %d, 最后签名序号: %d\n",
+		report.Files, report.Records, report.FirstSeq, report.LastSeq, report.Signatures, report.SignedSeq)
+	for _, w := range report.Warnings {
+		fmt.Println("[警告]", w)
+	}
+	for _, p := range report.Problems {
+		fmt.Println("[异常]", p)
+	}
+	if !report.OK() {
+		fmt.Println("审计记录校验未通过")
+		return 1
+	}
+	fmt.Println("审计记录校验通过")
+	return 0
+}
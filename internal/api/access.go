@@ -0,0 +1,87 @@
+package api
+
+import (
+	"slices"
+	"sort"
+	"time"
+
+	"cmder/internal/config"
+)
+
+// accessSchedule 解析后的访问时间配置
+type accessSchedule struct {
+	loc       *time.Location
+	windows   []config.AccessWindow
+	blackouts []config.DateRange
+}
+
+func newSchedule(a config.Access) accessSchedule {
+	// 日期格式已在加载配置时校验
+	blackouts, _ := a.BlackoutRanges()
+	return accessSchedule{loc: a.Location(), windows: a.Windows, blackouts: blackouts}
+}
+
+// blackout t 所在的日期是否禁止访问
+func (s accessSchedule) blackout(t time.Time) bool {
+	y, m, d := t.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	for _, r := range s.blackouts {
+		if !day.Before(r.From) && !day.After(r.To) {
+			return true
+		}
+	}
+	return false
+}
+
+// onDay 时间段是否在星期 wd 生效
+func onDay(w config.AccessWindow, wd time.Weekday) bool {
+	days := w.Weekdays()
+	return len(days) == 0 || slices.Contains(days, wd)
+}
+
+// open t 时刻是否允许访问
+func (s accessSchedule) open(t time.Time) bool {
+	t = t.In(s.loc)
+	if s.blackout(t) {
+		return false
+	}
+	if len(s.windows) == 0 {
+		return true
+	}
+	h, m, sec := t.Clock()
+	clock := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second
+	yesterday := (t.Weekday() + 6) % 7
+	for _, w := range s.windows {
+		overnight := w.End <= w.Start
+		switch {
+		case onDay(w, t.Weekday()) && clock >= w.Start && (overnight || clock < w.End):
+			return true
+		case overnight && onDay(w, yesterday) && clock < w.End:
+			// 前一天开始的跨夜时间段
+			return true
+		}
+	}
+	return false
+}
+
+// nextOpen 从 t 之后的下一个开放时间, 一年内没有开放时间时返回false
+// 开放只可能从某个时间段的开始或某天的零点(节假日结束)开始
+func (s accessSchedule) nextOpen(t time.Time) (time.Time, bool) {
+	t = t.In(s.loc)
+	y, m, d := t.Date()
+	for offset := 0; offset <= 366; offset++ {
+		day := time.Date(y, m, d+offset, 0, 0, 0, 0, s.loc)
+		candidates := []time.Time{day}
+		for _, w := range s.windows {
+			// 按当地时间计算开始时刻, 夏令时切换的当天一天不是24小时, 不能直接 day.Add
+			candidates = append(candidates, time.Date(y, m, d+offset, 0, 0, 0, int(w.Start), s.loc))
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+		for _, c := range candidates {
+			if c.After(t) && s.open(c) {
+				return c, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
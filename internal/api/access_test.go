@@ -0,0 +1,156 @@
+package api
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"cmder/internal/config"
+)
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestScheduleOpen(t *testing.T) {
+	shanghai := mustLocation(t, "Asia/Shanghai")
+	newYork := mustLocation(t, "America/New_York")
+	at := func(loc *time.Location, month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, loc)
+	}
+
+	office := config.Access{
+		TimeZone: "Asia/Shanghai",
+		Windows:  []config.AccessWindow{{Days: []string{"weekdays"}, Start: 9 * time.Hour, End: 18 * time.Hour}},
+	}
+	// 周五22点到周六2点
+	fridayNight := config.Access{
+		TimeZone: "Asia/Shanghai",
+		Windows:  []config.AccessWindow{{Days: []string{"fri"}, Start: 22 * time.Hour, End: 2 * time.Hour}},
+	}
+	holiday := config.Access{
+		TimeZone:  "Asia/Shanghai",
+		Windows:   []config.AccessWindow{{Start: 22 * time.Hour, End: 2 * time.Hour}},
+		Blackouts: []string{"2026-10-01~2026-10-07", "2026-12-25"},
+	}
+	nightly := config.Access{
+		TimeZone: "America/New_York",
+		Windows:  []config.AccessWindow{{Start: time.Hour, End: 3 * time.Hour}, {Start: 9 * time.Hour, End: 17 * time.Hour}},
+	}
+
+	tests := []struct {
+		name   string
+		access config.Access
+		t      time.Time
+		want   bool
+	}{
+		{"no windows", config.Access{}, at(shanghai, 10, 19, 3, 0), true},
+		{"weekday open", office, at(shanghai, 10, 19, 10, 0), true},
+		{"weekday start inclusive", office, at(shanghai, 10, 19, 9, 0), true},
+		{"weekday end exclusive", office, at(shanghai, 10, 19, 18, 0), false},
+		{"weekday before start", office, at(shanghai, 10, 19, 8, 59), false},
+		{"weekend closed", office, at(shanghai, 10, 24, 10, 0), false},
+
+		{"overnight evening", fridayNight, at(shanghai, 10, 23, 23, 0), true},
+		{"overnight after midnight", fridayNight, at(shanghai, 10, 24, 1, 59), true},
+		{"overnight end exclusive", fridayNight, at(shanghai, 10, 24, 2, 0), false},
+		{"overnight wrong day evening", fridayNight, at(shanghai, 10, 24, 23, 0), false},
+		{"overnight wrong day morning", fridayNight, at(shanghai, 10, 23, 1, 0), false},
+		{"overnight before start", fridayNight, at(shanghai, 10, 23, 21, 59), false},
+
+		{"blackout range", holiday, at(shanghai, 10, 5, 23, 0), false},
+		{"blackout single day", holiday, at(shanghai, 12, 25, 23, 0), false},
+		{"after blackout", holiday, at(shanghai, 10, 8, 23, 0), true},
+		// 按日期禁止: 前一天开始的跨夜时间段在禁止日的凌晨也不开放
+		{"blackout overnight tail", holiday, at(shanghai, 10, 1, 1, 0), false},
+		{"blackout ends at midnight", holiday, at(shanghai, 10, 8, 1, 0), true},
+
+		// 按配置的时区判断, 与传入时间的时区无关
+		{"utc input open", office, at(time.UTC, 10, 19, 2, 0), true},
+		{"utc input closed", office, at(time.UTC, 10, 19, 12, 0), false},
+		// UTC 周五16:30 是上海周六0:30
+		{"utc input across midnight", fridayNight, at(time.UTC, 10, 23, 16, 30), true},
+		// UTC 周六14:30 是上海周六22:30, 跨夜时间段只在周五开始
+		{"utc input weekday in zone", fridayNight, at(time.UTC, 10, 24, 14, 30), false},
+		{"blackout in zone", holiday, at(time.UTC, 9, 30, 17, 0), false},
+
+		// 2026-03-08 2:00 EST 切换为 3:00 EDT
+		{"dst spring before switch", nightly, at(newYork, 3, 8, 1, 30), true},
+		{"dst spring after switch", nightly, time.Date(2026, 3, 8, 7, 0, 0, 0, time.UTC), false},
+		{"dst spring office hours", nightly, at(newYork, 3, 8, 9, 30), true},
+		{"dst spring office hours utc", nightly, time.Date(2026, 3, 8, 13, 30, 0, 0, time.UTC), true},
+		// 2026-11-01 2:00 EDT 切换为 1:00 EST, 1点到2点出现两次
+		{"dst fall first 1:30", nightly, time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC), true},
+		{"dst fall second 1:30", nightly, time.Date(2026, 11, 1, 6, 30, 0, 0, time.UTC), true},
+		{"dst fall 8:30", nightly, time.Date(2026, 11, 1, 13, 30, 0, 0, time.UTC), false},
+		{"dst fall 9:30", nightly, time.Date(2026, 11, 1, 14, 30, 0, 0, time.UTC), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newSchedule(tt.access).open(tt.t); got != tt.want {
+				t.Fatalf("open(%s) = %t, want %t", tt.t.In(newSchedule(tt.access).loc), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleNextOpen(t *testing.T) {
+	shanghai := mustLocation(t, "Asia/Shanghai")
+	newYork := mustLocation(t, "America/New_York")
+	at := func(loc *time.Location, year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, loc)
+	}
+
+	office := config.Access{
+		TimeZone:  "Asia/Shanghai",
+		Windows:   []config.AccessWindow{{Days: []string{"weekdays"}, Start: 9 * time.Hour, End: 18 * time.Hour}},
+		Blackouts: []string{"2026-10-01~2026-10-07"},
+	}
+	fridayNight := config.Access{
+		TimeZone: "Asia/Shanghai",
+		Windows:  []config.AccessWindow{{Days: []string{"fri"}, Start: 22 * time.Hour, End: 2 * time.Hour}},
+	}
+	blackoutOnly := config.Access{TimeZone: "Asia/Shanghai", Blackouts: []string{"2026-10-01~2026-10-07"}}
+	newYorkOffice := config.Access{
+		TimeZone: "America/New_York",
+		Windows:  []config.AccessWindow{{Start: 9 * time.Hour, End: 17 * time.Hour}},
+	}
+
+	tests := []struct {
+		name   string
+		access config.Access
+		t      time.Time
+		want   time.Time
+	}{
+		{"later today", office, at(shanghai, 2026, 10, 19, 7, 0), at(shanghai, 2026, 10, 19, 9, 0)},
+		{"friday evening to monday", office, at(shanghai, 2026, 10, 23, 18, 0), at(shanghai, 2026, 10, 26, 9, 0)},
+		{"skip blackout", office, at(shanghai, 2026, 9, 30, 18, 0), at(shanghai, 2026, 10, 8, 9, 0)},
+		{"blackout ends at midnight", blackoutOnly, at(shanghai, 2026, 10, 3, 10, 0), at(shanghai, 2026, 10, 8, 0, 0)},
+		{"overnight next week", fridayNight, at(shanghai, 2026, 10, 24, 3, 0), at(shanghai, 2026, 10, 30, 22, 0)},
+		{"utc input", office, at(time.UTC, 2026, 10, 23, 12, 0), at(shanghai, 2026, 10, 26, 9, 0)},
+		// 夏令时切换当天一天只有23或25小时, 开放时间仍是当地9点
+		{"dst spring forward", newYorkOffice, at(newYork, 2026, 3, 7, 18, 0), at(newYork, 2026, 3, 8, 9, 0)},
+		{"dst fall back", newYorkOffice, at(newYork, 2026, 10, 31, 18, 0), at(newYork, 2026, 11, 1, 9, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSchedule(tt.access)
+			got, ok := s.nextOpen(tt.t)
+			if !ok || !got.Equal(tt.want) {
+				t.Fatalf("nextOpen(%s) = %s, %t, want %s", tt.t.In(s.loc), got, ok, tt.want)
+			}
+		})
+	}
+
+	t.Run("never open", func(t *testing.T) {
+		s := newSchedule(config.Access{TimeZone: "Asia/Shanghai", Blackouts: []string{"2026-01-01~2028-12-31"}})
+		if got, ok := s.nextOpen(at(shanghai, 2026, 10, 19, 10, 0)); ok {
+			t.Fatalf("nextOpen() = %s, want none", got)
+		}
+	})
+}
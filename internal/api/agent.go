@@ -11,6 +11,8 @@ import (
 	"syscall"
 	"time"
 
+	"cmder/internal/audit"
+
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
@@ -21,7 +23,6 @@ var upgrader = websocket.Upgrader{
 
 // AddCmd 添加命令任务
 func AddCmd(w http.ResponseWriter, r *http.Request) {
-	slog.Info("/api/cmd/run ...")
 	var req struct {
 		Cmd string `json:"cmd"`
 	}
@@ -29,37 +30,57 @@ func AddCmd(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "请求参数错误", http.StatusBadRequest)
 		return
 	}
+	if draining.Load() {
+		auditLog(r, audit.Record{Action: "cmd.reject", Command: req.Cmd, Status: http.StatusServiceUnavailable, Error: ErrDraining.Error()})
+		commandsRejected.Inc("draining")
+		http.Error(w, ErrDraining.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	// 检查是否是封禁的命令
 	if forbiddenCmds(req.Cmd) {
+		auditLog(r, audit.Record{Action: "cmd.reject", Command: req.Cmd, Status: http.StatusForbidden, Error: "封禁的命令"})
+		commandsRejected.Inc("forbidden")
 		http.Error(w, "封禁的命令,请联系管理员", http.StatusForbidden)
 		return
 	}
 
 	taskId := uuid.New().String()
+	logAttrs(r, slog.String("TaskId", taskId))
 	cmd := exec.Command("bash", "-c", req.Cmd)
+	// 独立的进程组, 关闭agent时可以终止任务启动的所有子进程
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	tk, err := newTask(taskId, cmd)
-	if err != nil {
-		http.Error(w, "初始化任务失败: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+	tk := newTask(taskId, req.Cmd, cmd)
+	tk.clientIP = extractIP(r)
+	tk.user = requestUser(r)
+	tk.requestId = requestId(r)
 	if err := tasks.Set(taskId, tk); err != nil {
+		auditLog(r, audit.Record{Action: "cmd.reject", Command: req.Cmd, Status: http.StatusTooManyRequests, Error: err.Error()})
+		commandsRejected.Inc("limit")
 		http.Error(w, err.Error(), http.StatusTooManyRequests)
 		return
 	}
+	auditLog(r, audit.Record{Action: "cmd.add", Command: req.Cmd, TaskId: taskId})
 
 	_ = json.NewEncoder(w).Encode(map[string]string{"task_id": taskId})
 }
 
 // OutCmd 执行任务并获取输出
 func OutCmd(w http.ResponseWriter, r *http.Request) {
-	slog.Info("/api/cmd/out ...")
 	taskId := r.URL.Query().Get("task_id")
 	rtask, ok := tasks.Get(taskId)
 	if !ok {
 		http.Error(w, "任务未找到", http.StatusNotFound)
 		return
 	}
+	// 关闭过程中不再启动新任务, 已运行的任务仍可查看输出
+	rtask.mu.Lock()
+	pending := !rtask.started
+	rtask.mu.Unlock()
+	if pending && draining.Load() {
+		http.Error(w, ErrDraining.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -70,50 +91,53 @@ func OutCmd(w http.ResponseWriter, r *http.Request) {
 
 	// 启动任务，只会执行一次
 	rtask.mu.Lock()
-	if !rtask.started {
-		if err := rtask.Cmd.Start(); err != nil {
-			rtask.mu.Unlock()
-			http.Error(w, "运行任务失败: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		rtask.started = true
-
-		// 异步读取 stdout/stderr 并广播
-		go streamOutput(bufio.NewReader(rtask.stdout), rtask)
-		go streamOutput(bufio.NewReader(rtask.stderr), rtask)
-
-		// 等待进程退出
-		go func() {
-			err := rtask.Cmd.Wait()
-			if err != nil {
-				if exitErr, ok := err.(*exec.ExitError); ok {
-					if _, ok := exitErr.Sys().(syscall.WaitStatus); ok {
-						rtask.closeAll("=============== 命令运行异常退出 ===============")
-					}
-				}
-			} else {
-				if _, ok := rtask.Cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
-					rtask.closeAll("=============== 命令运行正常退出 ===============")
-				}
-			}
-			tasks.Delete(taskId)
-		}()
+	if rtask.started {
+		rtask.mu.Unlock()
+		return
+	}
+	rtask.target = r.URL.Query().Get("name")
+	if err := rtask.start(); err != nil {
+		rtask.mu.Unlock()
+		auditLog(r, audit.Record{Action: "cmd.exit", ClientIP: rtask.clientIP, Command: rtask.command, TaskId: taskId, Error: err.Error()})
+		http.Error(w, "运行任务失败: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 	rtask.mu.Unlock()
+	// 保存任务表, agent重启后可以接管
+	tasks.save()
+
+	// 等待进程退出
+	go rtask.watch(func() (*int, error) {
+		err := rtask.Cmd.Wait()
+		return exitCode(rtask.Cmd.ProcessState), err
+	})
 }
 
 // ListTask 查询添加了哪些命令任务
 func ListTask(w http.ResponseWriter, r *http.Request) {
-	slog.Info("/api/cmd/ids ...")
 	_ = json.NewEncoder(w).Encode(map[string]any{
 		"target": r.URL.Query().Get("name"),
 		"tasks":  tasks.All(),
+		"lost":   tasks.Lost(),
 	})
 }
 
+// scriptEnd 脚本结束标记, 需单独作为一条消息发送; 脚本内容中的EOF(如heredoc)不受影响
+const scriptEnd = "__EOF__"
+
+// isScriptEnd 消息是否为脚本结束标记, 兼容旧版页面发送的 "EOF"
+func isScriptEnd(msg []byte) bool {
+	s := strings.TrimSpace(string(msg))
+	return s == scriptEnd || s == "EOF"
+}
+
 // RunScriptWS 执行脚本接口
 func RunScriptWS(w http.ResponseWriter, r *http.Request) {
-	slog.Info("/api/cmd/runws ...")
+	if draining.Load() {
+		commandsRejected.Inc("draining")
+		http.Error(w, ErrDraining.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		http.Error(w, "WebSocket upgrade failed: "+err.Error(), http.StatusInternalServerError)
@@ -121,8 +145,10 @@ func RunScriptWS(w http.ResponseWriter, r *http.Request) {
 	}
 	defer func() { _ = conn.Close() }()
 	taskID := uuid.New().String()
+	logAttrs(r, slog.String("TaskId", taskID))
 	// 用 bash -s 从 stdin 读取脚本
 	cmd := exec.Command("bash", "-s")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		_ = conn.WriteMessage(websocket.TextMessage, []byte("init stdin failed: "+err.Error()))
@@ -141,10 +167,16 @@ func RunScriptWS(w http.ResponseWriter, r *http.Request) {
 	// 告知客户端 task_id
 	conn.WriteJSON(map[string]any{"task_id": taskID, "status": "started", "time": time.Now().Format(time.RFC3339)})
 	if err := cmd.Start(); err != nil {
+		auditLog(r, audit.Record{Action: "script.run", TaskId: taskID, Error: err.Error()})
 		conn.WriteMessage(websocket.TextMessage, []byte("start failed: "+err.Error()))
 		return
 	}
-	// 读客户端脚本文本 -> 写入 bash stdin
+	startAt := time.Now()
+	runningScripts.Add(1)
+	run := scriptRuns.add(taskID, conn, cmd)
+	defer scriptRuns.remove(taskID)
+	// 读客户端脚本文本 -> 写入 bash stdin, 同时保留一份用于审计
+	var script strings.Builder
 	doneWrite := make(chan struct{})
 	go func() {
 		defer close(doneWrite)
@@ -158,16 +190,17 @@ func RunScriptWS(w http.ResponseWriter, r *http.Request) {
 			if mt != websocket.TextMessage && mt != websocket.BinaryMessage {
 				continue
 			}
-			// 约定 "__EOF__" 作为脚本结束
-			if strings.Contains(string(msg), "EOF") {
+			if isScriptEnd(msg) {
 				return
 			}
 			// 写入脚本内容，并确保以换行结尾
 			if _, err := stdin.Write(msg); err != nil {
 				return
 			}
+			script.Write(msg)
 			if len(msg) == 0 || msg[len(msg)-1] != '\n' {
 				stdin.Write([]byte("\n"))
+				script.WriteByte('\n')
 			}
 		}
 	}()
@@ -179,7 +212,7 @@ func RunScriptWS(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				return
 			}
-			_ = conn.WriteMessage(websocket.TextMessage, line)
+			_ = run.write(line)
 		}
 	}()
 	go func() {
@@ -189,13 +222,27 @@ func RunScriptWS(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				return
 			}
-			_ = conn.WriteMessage(websocket.TextMessage, line)
+			_ = run.write(line)
 		}
 	}()
 	// 等待客户端完成发送
 	<-doneWrite
 	// 等待进程退出并回传退出码
-	if err := cmd.Wait(); err != nil {
+	err = cmd.Wait()
+	runningScripts.Add(-1)
+	rec := audit.Record{
+		Action:     "script.run",
+		Command:    script.String(),
+		TaskId:     taskID,
+		ExitCode:   exitCode(cmd.ProcessState),
+		DurationMs: time.Since(startAt).Milliseconds(),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	auditLog(r, rec)
+	observeExit("script", time.Since(startAt).Seconds(), rec.ExitCode)
+	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			if _, ok := exitErr.Sys().(syscall.WaitStatus); ok {
 				// conn.WriteJSON(map[string]any{"status": "exit", "code": ws.ExitStatus()})
@@ -204,7 +251,7 @@ func RunScriptWS(w http.ResponseWriter, r *http.Request) {
 		}
 		// conn.WriteJSON(map[string]any{"status": "exit", "error": err.Error()})
 		errMsg := fmt.Sprintf("===== 报错: %v =====", err.Error())
-		conn.WriteMessage(websocket.TextMessage, []byte(errMsg))
+		_ = run.write([]byte(errMsg))
 
 		return
 	}
@@ -214,5 +261,5 @@ func RunScriptWS(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	conn.WriteMessage(websocket.TextMessage, []byte("=============== 脚本运行完成 ==============="))
+	_ = run.write([]byte("=============== 脚本运行完成 ==============="))
 }
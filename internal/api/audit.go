@@ -0,0 +1,204 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cmder/internal/audit"
+	"cmder/internal/config"
+)
+
+// auditor 审计日志写入器, 未初始化时不记录
+var auditor *audit.Logger
+
+// InitAudit 初始化审计日志, source 为 agent 或 proxy
+func InitAudit(provider config.AuditProvider, source string) error {
+	l, err := audit.New(provider.GetAudit(), source)
+	if err != nil {
+		return err
+	}
+	auditor = l
+	return nil
+}
+
+// CloseAudit 关闭审计日志
+func CloseAudit() error {
+	return auditor.Close()
+}
+
+// auditLog 补充请求相关信息后写入审计记录
+func auditLog(r *http.Request, rec audit.Record) {
+	if rec.ClientIP == "" {
+		rec.ClientIP = extractIP(r)
+	}
+	if rec.Target == "" {
+		rec.Target = r.URL.Query().Get("name")
+	}
+	if rec.User == "" {
+		rec.User = requestUser(r)
+	}
+	if rec.RequestId == "" {
+		rec.RequestId = requestId(r)
+	}
+	// 紧急访问期间的操作标记所属的紧急访问(只有proxy登录用户)
+	if user := requestUser(r); user != "" && rec.Detail == "" && !strings.HasPrefix(rec.Action, "breakglass.") && requestToken(r) == nil {
+		if g := breakGlass.Active(user); g != nil {
+			rec.Detail = "break-glass " + g.Id
+		}
+	}
+	auditor.Log(rec)
+}
+
+// exitCode 获取已结束进程的退出码
+func exitCode(ps *os.ProcessState) *int {
+	if ps == nil {
+		return nil
+	}
+	return audit.ExitCode(ps.ExitCode())
+}
+
+// QueryAudit 查询审计记录
+// 支持参数: from,to(RFC3339) action user target task_id request_id ip limit
+func QueryAudit(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "没有权限", http.StatusForbidden)
+		return
+	}
+	q := r.URL.Query()
+	f := audit.Filter{
+		Action:    q.Get("action"),
+		User:      q.Get("user"),
+		Target:    q.Get("target"),
+		TaskId:    q.Get("task_id"),
+		RequestId: q.Get("request_id"),
+		ClientIP:  q.Get("ip"),
+	}
+	var err error
+	if v := q.Get("from"); v != "" {
+		if f.From, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "无效的开始时间: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if f.To, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "无效的结束时间: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 || f.Limit > 10000 {
+			http.Error(w, "无效的limit: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	records, err := auditor.Query(f)
+	if err != nil {
+		http.Error(w, "查询审计记录失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if records == nil {
+		records = []audit.Record{}
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"records": records})
+}
+
+// maxCaptureBody 审计时最多截取的响应体大小
+const maxCaptureBody = 4096
+
+// statusWriter 记录响应状态码, 并截取响应体开头部分用于审计
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	if n := maxCaptureBody - len(s.body); n > 0 {
+		s.body = append(s.body, b[:min(n, len(b))]...)
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseWriter不支持Hijack")
+	}
+	return h.Hijack()
+}
+
+// taskIdFrom 从agent返回的json中提取task_id
+func taskIdFrom(body []byte) string {
+	var v struct {
+		TaskId string `json:"task_id"`
+	}
+	_ = json.Unmarshal(body, &v)
+	return v.TaskId
+}
+
+// wsTap 截取经过proxy的websocket消息用于审计
+type wsTap struct {
+	mu     sync.Mutex
+	taskId string
+	script strings.Builder
+}
+
+// fromClient 记录客户端发送的脚本内容
+func (t *wsTap) fromClient(msg []byte) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.script.Len()+len(msg) > 1<<20 || isScriptEnd(msg) {
+		return
+	}
+	t.script.Write(msg)
+	if len(msg) == 0 || msg[len(msg)-1] != '\n' {
+		t.script.WriteByte('\n')
+	}
+}
+
+// fromBackend 记录agent返回的task_id
+func (t *wsTap) fromBackend(msg []byte) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.taskId == "" {
+		t.taskId = taskIdFrom(msg)
+	}
+}
+
+// result 返回截取到的task_id和脚本内容
+func (t *wsTap) result() (string, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.taskId, t.script.String()
+}
@@ -0,0 +1,208 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"cmder/internal/audit"
+	"cmder/internal/config"
+)
+
+// bans IP黑名单和自动封禁, 未初始化时不封禁
+var bans = &banList{entries: make(map[string]*banEntry)}
+
+// banEntry 一个IP的失败记录和封禁状态
+type banEntry struct {
+	failures []time.Time // 窗口内的失败时间
+	until    time.Time   // 封禁截止时间
+	strikes  int         // 被封禁的次数, 用于计算封禁时长
+	lastBan  time.Time
+	reason   string // 最后一次失败的原因
+}
+
+// banInfo 封禁列表接口的返回项
+type banInfo struct {
+	IP       string    `json:"ip"`
+	Until    time.Time `json:"until"`
+	Strikes  int       `json:"strikes"`
+	Reason   string    `json:"reason"`
+	Failures int       `json:"failures"` // 当前窗口内的失败次数
+}
+
+type banList struct {
+	mu        sync.Mutex
+	cfg       config.Ban
+	black     []*net.IPNet
+	exempt    []*net.IPNet // 从不自动封禁
+	entries   map[string]*banEntry
+	lastSweep time.Time
+}
+
+// InitBan 加载黑名单和自动封禁配置
+func InitBan(provider config.BanProvider) error {
+	black, err := parseNets(provider.GetBlackList())
+	if err != nil {
+		return fmt.Errorf("解析blackList失败: %v", err)
+	}
+	exempt, err := parseNets(provider.GetBanExempt())
+	if err != nil {
+		return fmt.Errorf("解析不封禁的地址失败: %v", err)
+	}
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	bans.cfg = provider.GetBan()
+	bans.black = black
+	bans.exempt = exempt
+	return nil
+}
+
+// Blocked IP是否在黑名单中或处于封禁期
+func (b *banList) Blocked(ipStr string) (string, bool) {
+	ip := net.ParseIP(ipStr)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, n := range b.black {
+		if ip != nil && n.Contains(ip) {
+			return "黑名单", true
+		}
+	}
+	if e, ok := b.entries[ipStr]; ok && time.Now().Before(e.until) {
+		return "封禁至 " + e.until.Format(time.DateTime), true
+	}
+	return "", false
+}
+
+// Fail 记录一次认证/授权失败, 窗口内失败次数达到上限时封禁该IP
+// 可信反向代理和 GetBanExempt 中的地址(如agent前的proxy)只计数不封禁
+func (b *banList) Fail(r *http.Request, reason string) {
+	authFailures.Inc(reason)
+	ip := extractIP(r)
+	now := time.Now()
+
+	b.mu.Lock()
+	cfg := b.cfg
+	if cfg.Disabled || cfg.MaxFailures == 0 || ip == "" || b.exempted(ip) {
+		b.mu.Unlock()
+		return
+	}
+	b.sweep(now, cfg)
+	e, ok := b.entries[ip]
+	if !ok {
+		e = &banEntry{}
+		b.entries[ip] = e
+	}
+	e.reason = reason
+	e.failures = append(pruneBefore(e.failures, now.Add(-cfg.Window)), now)
+	if len(e.failures) < cfg.MaxFailures || now.Before(e.until) {
+		b.mu.Unlock()
+		return
+	}
+	// 长时间未再被封禁的IP重新计算封禁时长
+	if now.Sub(e.lastBan) > cfg.MaxBanTime {
+		e.strikes = 0
+	}
+	e.strikes++
+	d := cfg.BanTime << min(e.strikes-1, 16)
+	if d > cfg.MaxBanTime || d <= 0 {
+		d = cfg.MaxBanTime
+	}
+	e.until, e.lastBan, e.failures = now.Add(d), now, nil
+	strikes := e.strikes
+	b.mu.Unlock()
+
+	slog.WarnContext(r.Context(), "封禁IP", slog.String("IP", ip), slog.Duration("Duration", d), slog.Int("Strikes", strikes), slog.String("Reason", reason))
+	auditLog(r, audit.Record{Action: "ip.ban", ClientIP: ip, Detail: fmt.Sprintf("duration=%s strikes=%d reason=%s", d, strikes, reason)})
+}
+
+// exempted IP是否不自动封禁, 调用方需持有锁
+func (b *banList) exempted(ipStr string) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	if isTrustedProxy(ip) {
+		return true
+	}
+	for _, n := range b.exempt {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sweep 清理过期的记录, 调用方需持有锁
+func (b *banList) sweep(now time.Time, cfg config.Ban) {
+	if now.Sub(b.lastSweep) < time.Minute {
+		return
+	}
+	b.lastSweep = now
+	for ip, e := range b.entries {
+		e.failures = pruneBefore(e.failures, now.Add(-cfg.Window))
+		// 保留封禁次数直到超过最长封禁时长, 以便再次封禁时翻倍
+		if len(e.failures) == 0 && now.After(e.until) && now.Sub(e.lastBan) > cfg.MaxBanTime {
+			delete(b.entries, ip)
+		}
+	}
+}
+
+// pruneBefore 删除早于t的失败时间
+func pruneBefore(times []time.Time, t time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(t) {
+		i++
+	}
+	return times[i:]
+}
+
+// List 列出当前被封禁的IP
+func (b *banList) List() []banInfo {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := []banInfo{}
+	for ip, e := range b.entries {
+		if now.After(e.until) {
+			continue
+		}
+		list = append(list, banInfo{IP: ip, Until: e.until, Strikes: e.strikes, Reason: e.reason,
+			Failures: len(pruneBefore(e.failures, now.Add(-b.cfg.Window)))})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Until.Before(list[j].Until) })
+	return list
+}
+
+// Lift 解除封禁并清除失败记录
+func (b *banList) Lift(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[ip]
+	if !ok || time.Now().After(e.until) {
+		return false
+	}
+	delete(b.entries, ip)
+	return true
+}
+
+// ListBans 封禁列表接口
+func ListBans(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(map[string]any{"bans": bans.List()})
+}
+
+// LiftBan 解除封禁接口, 参数 ip
+func LiftBan(w http.ResponseWriter, r *http.Request) {
+	ip := r.URL.Query().Get("ip")
+	if !bans.Lift(ip) {
+		http.Error(w, "该IP未被封禁", http.StatusNotFound)
+		return
+	}
+	slog.InfoContext(r.Context(), "解除封禁", slog.String("IP", ip))
+	auditLog(r, audit.Record{Action: "ip.unban", Detail: ip})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,318 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"cmder/internal/audit"
+	"cmder/internal/config"
+)
+
+var (
+	ErrAckPending = errors.New("上一次紧急访问尚未被确认, 请联系管理员确认后再申请")
+
+	breakGlass = &breakGlassStore{}
+)
+
+// grant 一次紧急访问
+type grant struct {
+	Id      string     `json:"id"`
+	User    string     `json:"user"`
+	Reason  string     `json:"reason"`
+	Start   time.Time  `json:"start"`
+	Expires time.Time  `json:"expires"`
+	EndedAt *time.Time `json:"ended_at,omitempty"` // 提前结束
+	AckBy   string     `json:"ack_by,omitempty"`   // 事后确认人
+	AckAt   *time.Time `json:"ack_at,omitempty"`
+	AckNote string     `json:"ack_note,omitempty"`
+}
+
+func (g *grant) active(now time.Time) bool {
+	return g.EndedAt == nil && now.Before(g.Expires)
+}
+
+// breakGlassStore 紧急访问记录文件, 变更后整体重写; 未初始化(agent)时不启用
+type breakGlassStore struct {
+	mu     sync.Mutex
+	cfg    config.BreakGlass
+	loaded bool
+	grants []*grant
+}
+
+// InitBreakGlass 初始化紧急访问, 读取已有记录
+func InitBreakGlass(provider config.BreakGlassProvider) error {
+	breakGlass.mu.Lock()
+	defer breakGlass.mu.Unlock()
+	breakGlass.cfg = provider.GetBreakGlass()
+	breakGlass.loaded, breakGlass.grants = false, nil
+	return breakGlass.load()
+}
+
+// load 读取记录文件, 调用方需持有锁
+func (s *breakGlassStore) load() error {
+	if s.cfg.File == "" {
+		return errors.New("紧急访问未初始化")
+	}
+	if s.loaded {
+		return nil
+	}
+	data, err := os.ReadFile(s.cfg.File)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("读取紧急访问记录失败: %v", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.grants); err != nil {
+			return fmt.Errorf("解析紧急访问记录失败: %v", err)
+		}
+	}
+	s.loaded = true
+	return nil
+}
+
+func (s *breakGlassStore) save() error {
+	return writeJSONFile(s.cfg.File, s.grants)
+}
+
+// Active 用户当前生效的紧急访问
+func (s *breakGlassStore) Active(user string) *grant {
+	if user == "" {
+		return nil
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cfg.File == "" {
+		return nil
+	}
+	if err := s.load(); err != nil {
+		slog.Error("加载紧急访问记录失败", slog.String("Err", err.Error()))
+		return nil
+	}
+	for _, g := range s.grants {
+		if g.User == user && g.active(now) {
+			cp := *g
+			return &cp
+		}
+	}
+	return nil
+}
+
+// Grant 立即授予紧急访问
+func (s *breakGlassStore) Grant(user, reason string, d time.Duration) (*grant, error) {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	for _, g := range s.grants {
+		if g.User != user {
+			continue
+		}
+		if g.active(now) {
+			cp := *g
+			return &cp, nil
+		}
+		if s.cfg.RequireAck && g.AckAt == nil {
+			return nil, ErrAckPending
+		}
+	}
+	g := &grant{Id: hex.EncodeToString(buf), User: user, Reason: reason, Start: now, Expires: now.Add(d)}
+	s.grants = append(s.grants, g)
+	if err := s.save(); err != nil {
+		s.grants = s.grants[:len(s.grants)-1]
+		return nil, err
+	}
+	cp := *g
+	return &cp, nil
+}
+
+// update 修改一条记录并保存
+func (s *breakGlassStore) update(id string, fn func(g *grant) error) (*grant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	i := slices.IndexFunc(s.grants, func(g *grant) bool { return g.Id == id })
+	if i < 0 {
+		return nil, os.ErrNotExist
+	}
+	old := *s.grants[i]
+	if err := fn(s.grants[i]); err != nil {
+		return nil, err
+	}
+	if err := s.save(); err != nil {
+		*s.grants[i] = old
+		return nil, err
+	}
+	cp := *s.grants[i]
+	return &cp, nil
+}
+
+// List 按时间倒序列出紧急访问记录, user 不为空时只列出该用户的
+func (s *breakGlassStore) List(user string) ([]grant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	list := []grant{}
+	for i := len(s.grants) - 1; i >= 0; i-- {
+		if user == "" || s.grants[i].User == user {
+			list = append(list, *s.grants[i])
+		}
+	}
+	return list, nil
+}
+
+// canBreakGlass 请求用户是否可以申请紧急访问(需启用登录, API令牌不可以)
+func canBreakGlass(r *http.Request) bool {
+	if !authEnabled() || requestToken(r) != nil || requestUser(r) == "" {
+		return false
+	}
+	if isAdmin(r) {
+		return true
+	}
+	return slices.ContainsFunc(userRoles(r), func(role config.Role) bool { return role.BreakGlass })
+}
+
+// breakGlassActive 请求用户是否处于紧急访问中
+func breakGlassActive(r *http.Request) bool {
+	if requestToken(r) != nil {
+		return false
+	}
+	return breakGlass.Active(requestUser(r)) != nil
+}
+
+// ---------------- 接口 ----------------
+
+// RequestBreakGlass 申请紧急访问, 立即生效
+func RequestBreakGlass(w http.ResponseWriter, r *http.Request) {
+	if !canBreakGlass(r) {
+		http.Error(w, "没有权限", http.StatusForbidden)
+		return
+	}
+	var req struct {
+		Reason   string `json:"reason"`
+		Duration string `json:"duration"` // 如 1h
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "请求参数错误", http.StatusBadRequest)
+		return
+	}
+	maxDuration := config.GetProxy().GetBreakGlass().MaxDuration
+	d, err := time.ParseDuration(req.Duration)
+	switch {
+	case len([]rune(req.Reason)) < 10:
+		http.Error(w, "请填写紧急访问原因(不少于10个字)", http.StatusBadRequest)
+		return
+	case err != nil || d <= 0 || d > maxDuration:
+		http.Error(w, fmt.Sprintf("无效的时长 %s, 最长 %s", req.Duration, maxDuration), http.StatusBadRequest)
+		return
+	}
+	g, err := breakGlass.Grant(requestUser(r), req.Reason, d)
+	if errors.Is(err, ErrAckPending) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "申请紧急访问失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.ErrorContext(r.Context(), "!!! 紧急访问已开启 !!!", slog.String("Id", g.Id),
+		slog.String("Reason", g.Reason), slog.Time("Expires", g.Expires), slog.String("IP", extractIP(r)))
+	auditLog(r, audit.Record{Action: "breakglass.grant", Detail: fmt.Sprintf("id=%s expires=%s reason=%s", g.Id, g.Expires.Format(time.RFC3339), g.Reason)})
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(g)
+}
+
+// EndBreakGlass 提前结束紧急访问(本人或管理员)
+func EndBreakGlass(w http.ResponseWriter, r *http.Request) {
+	user, admin := requestUser(r), isAdmin(r) && requestToken(r) == nil
+	g, err := breakGlass.update(r.PathValue("id"), func(g *grant) error {
+		if g.User != user && !admin {
+			return os.ErrPermission
+		}
+		if g.active(time.Now()) {
+			now := time.Now()
+			g.EndedAt = &now
+		}
+		return nil
+	})
+	if breakGlassError(w, err) {
+		return
+	}
+	auditLog(r, audit.Record{Action: "breakglass.end", Detail: fmt.Sprintf("id=%s user=%s", g.Id, g.User)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AckBreakGlass 另一位管理员事后确认紧急访问
+func AckBreakGlass(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Note string `json:"note"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	user := requestUser(r)
+	g, err := breakGlass.update(r.PathValue("id"), func(g *grant) error {
+		switch {
+		case requestToken(r) != nil || !isAdmin(r) || user == "":
+			return os.ErrPermission
+		case g.User == user:
+			return errors.New("不能确认自己的紧急访问")
+		case g.AckAt != nil:
+			return errors.New("已确认")
+		}
+		now := time.Now()
+		g.AckBy, g.AckAt, g.AckNote = user, &now, req.Note
+		return nil
+	})
+	if breakGlassError(w, err) {
+		return
+	}
+	auditLog(r, audit.Record{Action: "breakglass.ack", Detail: fmt.Sprintf("id=%s user=%s note=%s", g.Id, g.User, g.AckNote)})
+	_ = json.NewEncoder(w).Encode(g)
+}
+
+// ListBreakGlass 紧急访问记录, 管理员查看全部, 其他用户查看自己的
+func ListBreakGlass(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if isAdmin(r) && requestToken(r) == nil {
+		user = ""
+	}
+	list, err := breakGlass.List(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"grants": list})
+}
+
+// breakGlassError 输出紧急访问接口的错误, 无错误时返回false
+func breakGlassError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, "记录不存在", http.StatusNotFound)
+	case errors.Is(err, os.ErrPermission):
+		http.Error(w, "没有权限", http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+	return true
+}
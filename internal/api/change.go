@@ -0,0 +1,134 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cmder/internal/config"
+)
+
+// changeActions 变更窗口默认限制的操作
+var changeActions = []string{config.ActionCmd, config.ActionScript, config.ActionKill, config.ActionUpload}
+
+// classPatterns 已编译的命令类别正则
+var classPatterns sync.Map
+
+func compilePattern(p string) *regexp.Regexp {
+	if re, ok := classPatterns.Load(p); ok {
+		return re.(*regexp.Regexp)
+	}
+	// 已在加载配置时校验
+	re := regexp.MustCompile(p)
+	classPatterns.Store(p, re)
+	return re
+}
+
+// inClasses 命令是否属于任一类别
+func inClasses(line string, classes []string) bool {
+	all := config.GetProxy().CommandClasses
+	for _, c := range classes {
+		for _, p := range all[c] {
+			if compilePattern(p).MatchString(line) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// commandLines 命令或脚本中的非空、非注释行
+func commandLines(command string) []string {
+	var lines []string
+	for _, line := range strings.Split(command, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// restricts 变更窗口是否限制该操作
+// known 为false表示命令内容未知(如通过websocket发送的脚本), 此时按受限处理
+func restricts(cw config.ChangeWindow, target, action, command string, known bool) bool {
+	targets := cw.Targets
+	if len(targets) == 0 {
+		targets = []string{"*"}
+	}
+	if !ruleHasTarget(config.Rule{Targets: targets}, target, targetGroups(target)) {
+		return false
+	}
+	actions := cw.Actions
+	if len(actions) == 0 {
+		actions = changeActions
+	}
+	if !slices.Contains(actions, action) {
+		return false
+	}
+	if (action != config.ActionCmd && action != config.ActionScript) || !known {
+		return true
+	}
+	lines := commandLines(command)
+	if len(cw.Except) > 0 && len(lines) > 0 && !slices.ContainsFunc(lines, func(l string) bool { return !inClasses(l, cw.Except) }) {
+		return false
+	}
+	if len(cw.Classes) > 0 && !slices.ContainsFunc(lines, func(l string) bool { return inClasses(l, cw.Classes) }) {
+		return false
+	}
+	return true
+}
+
+// checkChangeWindow 检查操作是否在访问时间和变更窗口内, 不允许时返回提示信息和下次开放时间; 紧急访问中不受限制
+// 访问时间(access)对所有target的变更操作(cmd script kill upload)生效, 每一行都属于accessExcept类别的命令(如只读命令)不受限制
+func checkChangeWindow(r *http.Request, target, action, command string, known bool) (string, time.Time, bool) {
+	if breakGlassActive(r) {
+		return "", time.Time{}, true
+	}
+	now := time.Now()
+	p := config.GetProxy()
+	// 先排除不受限制的命令类别, 再检查访问时间
+	global := config.ChangeWindow{Except: p.AccessExcept, Access: p.GetAccess()}
+	if restricts(global, target, action, command, known) {
+		if schedule := newSchedule(global.Access); !schedule.open(now) {
+			msg, reopen := closedMessage(r, "当前不在允许访问的时间段", schedule, now)
+			return msg, reopen, false
+		}
+	}
+	for _, cw := range p.ChangeWindows {
+		if !restricts(cw, target, action, command, known) {
+			continue
+		}
+		schedule := newSchedule(cw.Access)
+		if schedule.open(now) {
+			continue
+		}
+		msg, reopen := closedMessage(r, fmt.Sprintf("不在变更窗口 %s 内", cw.Name), schedule, now)
+		return msg, reopen, false
+	}
+	return "", time.Time{}, true
+}
+
+// closedMessage 拒绝时的提示: 下次开放时间, 以及可以申请紧急访问; 没有开放时间时返回零值
+func closedMessage(r *http.Request, msg string, schedule accessSchedule, now time.Time) (string, time.Time) {
+	reopen, ok := schedule.nextOpen(now)
+	if ok {
+		msg += ", 下次开放时间: " + reopen.Format("2006-01-02 15:04 MST") + " (" + schedule.loc.String() + ")"
+	}
+	if canBreakGlass(r) {
+		msg += "; 如需紧急访问请通过 POST /api/breakglass 填写原因申请"
+	}
+	return msg, reopen
+}
+
+// retryAfter 设置Retry-After为距下次开放的秒数
+func retryAfter(w http.ResponseWriter, reopen, now time.Time) {
+	if !reopen.IsZero() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(reopen.Sub(now).Seconds()))))
+	}
+}
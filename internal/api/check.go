@@ -0,0 +1,96 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"cmder/internal/audit"
+	"cmder/internal/config"
+)
+
+// CheckAgent 检查agent配置引用的证书、密钥和任务表文件能否正常加载, 返回全部问题
+func CheckAgent(c *config.Agent) error {
+	var errs []error
+	if _, err := ServerTLSConfig(c.TLS); err != nil {
+		errs = append(errs, fmt.Errorf("tls: %v", err))
+	}
+	if err := checkAuditKey(c.GetAudit()); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkTaskState(c.TaskState); err != nil {
+		errs = append(errs, fmt.Errorf("taskState: %v", err))
+	}
+	return errors.Join(errs...)
+}
+
+// checkTaskState 检查任务表能否解析
+func checkTaskState(cfg config.TaskState) error {
+	data, err := os.ReadFile(filepath.Join(cfg.Dir, taskStateFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []taskRecord
+	return json.Unmarshal(data, &records)
+}
+
+// CheckProxy 检查proxy配置引用的证书、密钥、用户和记录文件能否正常加载, 返回全部问题
+func CheckProxy(c *config.Proxy) error {
+	var errs []error
+	if _, err := ServerTLSConfig(c.TLS); err != nil {
+		errs = append(errs, fmt.Errorf("tls: %v", err))
+	}
+	if err := checkAuditKey(c.GetAudit()); err != nil {
+		errs = append(errs, err)
+	}
+	if c.PrivateKey != "" {
+		if _, err := audit.LoadPrivateKey(c.PrivateKey); err != nil {
+			errs = append(errs, fmt.Errorf("privateKey: %v", err))
+		}
+	}
+	for _, t := range c.Targets {
+		if _, err := agentTLSConfig(t); err != nil {
+			errs = append(errs, fmt.Errorf("主机 %s: %v", t.Name, err))
+		}
+	}
+	if auth := c.GetAuth(); auth.UsersFile != "" {
+		store := &userStore{}
+		if err := store.load(auth.UsersFile); err != nil {
+			errs = append(errs, err)
+		}
+		roles := make([]string, 0, len(c.Roles))
+		for _, r := range c.Roles {
+			roles = append(roles, r.Name)
+		}
+		for _, u := range store.users {
+			for _, r := range u.Roles {
+				if len(roles) > 0 && !slices.Contains(roles, r) {
+					errs = append(errs, fmt.Errorf("用户 %s 的角色 %s 未在roles中定义", u.Name, r))
+				}
+			}
+		}
+		if err := (&tokenStore{}).load(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := (&breakGlassStore{cfg: c.GetBreakGlass()}).load(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func checkAuditKey(a config.Audit) error {
+	if a.SignKey == "" {
+		return nil
+	}
+	if _, err := audit.LoadPrivateKey(a.SignKey); err != nil {
+		return fmt.Errorf("audit.signKey: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"cmder/internal/config"
+)
+
+// trustedProxies 可信的反向代理, 只有来自这些地址的请求才读取转发头
+// 重新加载配置时整体替换, 处理中的请求读取的是替换前或替换后的完整列表
+var trustedProxies atomic.Pointer[[]*net.IPNet]
+
+// InitTrustedProxies 解析可信反向代理列表(IP或CIDR)
+func InitTrustedProxies(provider config.TrustedProxyProvider) error {
+	nets, err := parseNets(provider.GetTrustedProxies())
+	if err != nil {
+		return err
+	}
+	trustedProxies.Store(&nets)
+	return nil
+}
+
+// parseNets 解析IP或CIDR列表, 单个IP按 /32 或 /128 处理
+func parseNets(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("无效的IP: %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("无效的CIDR: %s", entry)
+		}
+		nets = append(nets, cidr)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	nets := trustedProxies.Load()
+	if nets == nil {
+		return false
+	}
+	for _, n := range *nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractIP 提取请求中的客户端 IP
+// 只有 RemoteAddr 是可信反向代理时才读取转发头(Forwarded > X-Forwarded-For > X-Real-IP),
+// 从右向左跳过可信代理, 第一个不可信的地址即为客户端
+func extractIP(r *http.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	ip := net.ParseIP(remote)
+	if ip == nil || !isTrustedProxy(ip) {
+		return remote
+	}
+
+	var hops []string
+	if fwd := r.Header.Values("Forwarded"); len(fwd) > 0 {
+		hops = forwardedFor(fwd)
+	} else if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		for _, v := range xff {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+	} else if xr := r.Header.Get("X-Real-IP"); xr != "" {
+		hops = []string{xr}
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(stripPort(hops[i]))
+		if hop == nil {
+			// 无法识别的地址(如 unknown 或混淆标识), 以报告它的代理为准
+			break
+		}
+		client = hop.String()
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedFor 解析 RFC 7239 Forwarded 头中按顺序出现的 for= 地址
+//
+//	Forwarded: for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					hops = append(hops, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// stripPort 去掉地址中的端口和IPv6的方括号
+func stripPort(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// stubProxies 测试用的可信反向代理配置
+type stubProxies []string
+
+func (p stubProxies) GetTrustedProxies() []string { return p }
+
+func setTrustedProxies(t *testing.T, entries ...string) {
+	t.Helper()
+	if err := InitTrustedProxies(stubProxies(entries)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = InitTrustedProxies(stubProxies(nil)) })
+}
+
+func TestExtractIP(t *testing.T) {
+	setTrustedProxies(t, "10.0.0.0/8", "192.0.2.1", "2001:db8::1")
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string][]string
+		want    string
+	}{
+		{
+			name:   "no proxy",
+			remote: "203.0.113.9:5000",
+			want:   "203.0.113.9",
+		},
+		{
+			name:   "xff single hop",
+			remote: "10.0.0.2:5000",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"203.0.113.9"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			// 从右向左跳过可信代理, 左侧由客户端伪造的地址被忽略
+			name:   "xff right to left",
+			remote: "10.0.0.2:5000",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"1.1.1.1, 203.0.113.9, 10.0.0.7"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			name:   "xff multiple headers",
+			remote: "10.0.0.2:5000",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"1.1.1.1", "203.0.113.9, 10.0.0.7"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			// 所有地址都是可信代理时取最左侧的地址
+			name:   "xff all trusted",
+			remote: "10.0.0.2:5000",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"10.0.0.5, 10.0.0.7"},
+			},
+			want: "10.0.0.5",
+		},
+		{
+			name:   "xff unknown hop",
+			remote: "10.0.0.2:5000",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"203.0.113.9, unknown"},
+			},
+			want: "10.0.0.2",
+		},
+		{
+			name:   "forwarded",
+			remote: "10.0.0.2:5000",
+			headers: map[string][]string{
+				"Forwarded": {"for=203.0.113.9;proto=https"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			name:   "forwarded quoted with port",
+			remote: "10.0.0.2:5000",
+			headers: map[string][]string{
+				"Forwarded": {`for="203.0.113.9:4711"`},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			name:   "forwarded ipv6",
+			remote: "10.0.0.2:5000",
+			headers: map[string][]string{
+				"Forwarded": {`For="[2001:db8:cafe::17]"`},
+			},
+			want: "2001:db8:cafe::17",
+		},
+		{
+			name:   "forwarded ipv6 with port",
+			remote: "10.0.0.2:5000",
+			headers: map[string][]string{
+				"Forwarded": {`for="[2001:db8:cafe::17]:4711"`},
+			},
+			want: "2001:db8:cafe::17",
+		},
+		{
+			name:   "forwarded right to left",
+			remote: "10.0.0.2:5000",
+			headers: map[string][]string{
+				"Forwarded": {`for=1.1.1.1, for=203.0.113.9;by=10.0.0.7, for="[2001:db8::1]:443"`},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			name:   "forwarded obfuscated",
+			remote: "10.0.0.2:5000",
+			headers: map[string][]string{
+				"Forwarded": {"for=_hidden"},
+			},
+			want: "10.0.0.2",
+		},
+		{
+			// 同时存在时优先使用 Forwarded
+			name:   "forwarded before xff",
+			remote: "10.0.0.2:5000",
+			headers: map[string][]string{
+				"Forwarded":       {"for=203.0.113.9"},
+				"X-Forwarded-For": {"198.51.100.1"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			name:   "x-real-ip",
+			remote: "192.0.2.1:5000",
+			headers: map[string][]string{
+				"X-Real-Ip": {"203.0.113.9"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			name:   "ipv6 trusted proxy",
+			remote: "[2001:db8::1]:5000",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"203.0.113.9"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			name:   "spoofed xff from untrusted",
+			remote: "203.0.113.9:5000",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"10.0.0.2"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			name:   "spoofed forwarded from untrusted",
+			remote: "203.0.113.9:5000",
+			headers: map[string][]string{
+				"Forwarded": {"for=127.0.0.1"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			name:   "spoofed x-real-ip from untrusted",
+			remote: "[2001:db8::2]:5000",
+			headers: map[string][]string{
+				"X-Real-Ip": {"127.0.0.1"},
+			},
+			want: "2001:db8::2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for k, values := range tt.headers {
+				for _, v := range values {
+					r.Header.Add(k, v)
+				}
+			}
+			if got := extractIP(r); got != tt.want {
+				t.Fatalf("extractIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	got := forwardedFor([]string{
+		`for=192.0.2.60;proto=http;by=203.0.113.43`,
+		`for="[2001:db8:cafe::17]:4711", FOR=198.51.100.17`,
+	})
+	want := []string{"192.0.2.60", "[2001:db8:cafe::17]:4711", "198.51.100.17"}
+	if len(got) != len(want) {
+		t.Fatalf("forwardedFor() = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("forwardedFor() = %q, want %q", got, want)
+		}
+	}
+}
@@ -1,61 +1,23 @@
 package api
 
 import (
-	"bufio"
+	"bytes"
 	"cmder/internal/config"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
-	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 // ---------------- 工具函数 ----------------
 
-// streamOutput 缓存io行读取标准输出和标准错误
-func streamOutput(reader *bufio.Reader, t *task) {
-	for {
-		line, _, err := reader.ReadLine()
-		if err != nil {
-			break
-		}
-		t.broadcast(line)
-	}
-}
-
-// extractIP 提取请求中的客户端 IP（X-Forwarded-For > X-Real-IP > RemoteAddr）
-func extractIP(r *http.Request) string {
-	if xf := r.Header.Get("X-Forwarded-For"); xf != "" {
-		parts := strings.Split(xf, ",")
-		for _, p := range parts {
-			ip := strings.TrimSpace(p)
-			if ip != "" {
-				if host, _, err := net.SplitHostPort(ip); err == nil {
-					return host
-				}
-				return ip
-			}
-		}
-	}
-	if xr := r.Header.Get("X-Real-IP"); xr != "" {
-		if host, _, err := net.SplitHostPort(xr); err == nil {
-			return host
-		}
-		return strings.TrimSpace(xr)
-	}
-	if ra := r.RemoteAddr; ra != "" {
-		if host, _, err := net.SplitHostPort(ra); err == nil {
-			return host
-		}
-		return ra
-	}
-	return ""
-}
-
 // iPInWhiteList 检查 IP 是否在白名单中，支持 IP 和 CIDR
 func iPInWhiteList(provider config.WhiteListProvider, r *http.Request) bool {
 	ipStr := extractIP(r)
@@ -67,7 +29,7 @@ func iPInWhiteList(provider config.WhiteListProvider, r *http.Request) bool {
 		return false
 	}
 
-	slog.Info("来访地址", slog.String("IP", ipStr))
+	slog.DebugContext(r.Context(), "来访地址", slog.String("IP", ipStr))
 
 	for _, entry := range provider.GetWhiteList() {
 		entry = strings.TrimSpace(entry)
@@ -78,22 +40,22 @@ func iPInWhiteList(provider config.WhiteListProvider, r *http.Request) bool {
 		if strings.Contains(entry, "/") {
 			_, cidr, err := net.ParseCIDR(entry)
 			if err != nil {
-				slog.Warn("解析 CIDR 失败", slog.String("entry", entry), slog.Any("err", err))
+				slog.WarnContext(r.Context(), "解析 CIDR 失败", slog.String("entry", entry), slog.Any("err", err))
 				continue
 			}
 			if cidr.Contains(ip) {
-				slog.Info("命中白名单(CIDR)", slog.String("entry", entry))
+				slog.DebugContext(r.Context(), "命中白名单(CIDR)", slog.String("entry", entry))
 				return true
 			}
 			continue
 		}
 		// 直接 IP 匹配
 		if entry == ipStr {
-			slog.Info("命中白名单(IP)", slog.String("entry", entry))
+			slog.DebugContext(r.Context(), "命中白名单(IP)", slog.String("entry", entry))
 			return true
 		}
 		if parsed := net.ParseIP(entry); parsed != nil && parsed.Equal(ip) {
-			slog.Info("命中白名单(IP parsed)", slog.String("entry", entry))
+			slog.DebugContext(r.Context(), "命中白名单(IP parsed)", slog.String("entry", entry))
 			return true
 		}
 	}
@@ -161,9 +123,83 @@ func copyHeaders(dst, src http.Header, skip map[string]struct{}) {
 	}
 }
 
+// setUserHeader 将登录用户传递给agent
+func setUserHeader(h http.Header, r *http.Request) {
+	if user := requestUser(r); user != "" {
+		h.Set(userHeader, user)
+	}
+}
+
+// hopHeaders 逐跳头, 只对单个连接有效, 不能转发(RFC 9110 7.6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// clientAuthHeaders 客户端的认证信息和转发信息, 由proxy重新生成, 不能透传给agent
+var clientAuthHeaders = append([]string{
+	"Cookie",
+	"Authorization",
+	userHeader,
+	"X-Forwarded-For",
+	"X-Real-Ip",
+	"Forwarded",
+}, signHeaders...)
+
+// removeHopHeaders 删除逐跳头以及 Connection 头中声明的头
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// setForwardedHeaders 追加 X-Forwarded-For 和 Forwarded(RFC 7239)
+// 请求来自可信反向代理时保留已有的转发链, 否则丢弃客户端伪造的转发头
+func setForwardedHeaders(h http.Header, r *http.Request) {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	var xff, fwd []string
+	if ip := net.ParseIP(remote); ip != nil && isTrustedProxy(ip) {
+		xff = r.Header.Values("X-Forwarded-For")
+		fwd = r.Header.Values("Forwarded")
+	}
+	xff = append(xff, remote)
+	h.Set("X-Forwarded-For", strings.Join(xff, ", "))
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	node := remote
+	if strings.Contains(node, ":") {
+		// IPv6地址需要加方括号和引号
+		node = `"[` + node + `]"`
+	}
+	fwd = append(fwd, fmt.Sprintf(`for=%s;host="%s";proto=%s`, node, r.Host, proto))
+	h.Set("Forwarded", strings.Join(fwd, ", "))
+}
+
 // forwardHTTP 转发http请求
-func forwardHTTP(w http.ResponseWriter, r *http.Request, targetURI string) {
-	u, err := url.Parse(targetURI)
+// 请求: 删除逐跳头和客户端的认证头, 追加转发头, 签名后发送, 客户端断开时取消agent请求
+// 响应: 删除逐跳头, 边读边写并及时flush, 支持分块输出
+func forwardHTTP(w http.ResponseWriter, r *http.Request, target config.Target) {
+	u, err := url.Parse(target.Address)
 	if err != nil {
 		http.Error(w, "无效的uri: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -171,35 +207,98 @@ func forwardHTTP(w http.ResponseWriter, r *http.Request, targetURI string) {
 	u.Path = singleJoinPath(u.Path, r.URL.Path)
 	u.RawQuery = r.URL.RawQuery
 
-	req, err := http.NewRequestWithContext(r.Context(), r.Method, u.String(), r.Body)
+	body, err := readBody(r)
+	if errors.Is(err, ErrBodyTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "读取请求失败: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// 使用客户端请求的上下文, 客户端断开时取消对agent的请求
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, u.String(), bytes.NewReader(body))
 	if err != nil {
 		http.Error(w, "新建转发请求失败: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	// 透传头
-	req.Header.Set("X-Security-Key", config.GetProxy().XSecurityKey)
 	copyHeaders(req.Header, r.Header, nil)
+	removeHopHeaders(req.Header)
+	for _, name := range clientAuthHeaders {
+		req.Header.Del(name)
+	}
+	setForwardedHeaders(req.Header, r)
+	setUserHeader(req.Header, r)
+	setRequestIdHeader(req.Header, r)
+	if err := signRequest(req.Header, req.Method, req.URL, body); err != nil {
+		http.Error(w, "请求签名失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	client, err := agentClient(target)
+	if err != nil {
+		http.Error(w, "TLS配置错误: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := client.Do(req)
 	if err != nil {
+		if r.Context().Err() != nil {
+			slog.InfoContext(r.Context(), "客户端已断开, 取消转发", slog.String("Uri", r.URL.Path))
+			return
+		}
 		http.Error(w, "http转发出错: "+err.Error(), http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
+	removeHopHeaders(resp.Header)
 	copyHeaders(w.Header(), resp.Header, nil)
+	// agent返回的请求ID与本次请求相同, 不重复添加
+	w.Header().Set(requestIdHeader, requestId(r))
+	// 预先声明trailer, 响应体结束后再写入值
+	for name := range resp.Trailer {
+		w.Header().Add("Trailer", name)
+	}
 	w.WriteHeader(resp.StatusCode)
-	_, _ = io.Copy(w, resp.Body)
+	if err := copyResponse(w, resp.Body); err != nil {
+		slog.WarnContext(r.Context(), "转发响应中断", slog.String("Uri", r.URL.Path), slog.String("Err", err.Error()))
+		return
+	}
+	for name, values := range resp.Trailer {
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
 }
 
-// forwardWebSocket 转发websocket请求
-func forwardWebSocket(w http.ResponseWriter, r *http.Request, targetURI string) {
-	// 1) 构造后端 ws/wss URL
+// copyResponse 复制响应体, 每次写入后flush, 使任务输出等流式响应及时到达客户端
+func copyResponse(w http.ResponseWriter, body io.Reader) error {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if ferr := rc.Flush(); ferr != nil && !errors.Is(ferr, http.ErrNotSupported) {
+				return ferr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// wsTargetURL 根据agent的http地址构造 ws/wss 请求地址
+func wsTargetURL(targetURI, path, rawQuery string) (*url.URL, error) {
 	wsURL, err := url.Parse(targetURI)
 	if err != nil {
-		slog.Error("无效的uri", slog.String("Err", err.Error()))
-		http.Error(w, "无效的uri: "+err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	switch strings.ToLower(wsURL.Scheme) {
 	case "http":
@@ -207,8 +306,20 @@ func forwardWebSocket(w http.ResponseWriter, r *http.Request, targetURI string)
 	case "https":
 		wsURL.Scheme = "wss"
 	}
-	wsURL.Path = singleJoinPath(wsURL.Path, r.URL.Path)
-	wsURL.RawQuery = r.URL.RawQuery
+	wsURL.Path = singleJoinPath(wsURL.Path, path)
+	wsURL.RawQuery = rawQuery
+	return wsURL, nil
+}
+
+// forwardWebSocket 转发websocket请求
+func forwardWebSocket(w http.ResponseWriter, r *http.Request, target config.Target, tap *wsTap) {
+	// 1) 构造后端 ws/wss URL
+	wsURL, err := wsTargetURL(target.Address, r.URL.Path, r.URL.RawQuery)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "无效的uri", slog.String("Err", err.Error()))
+		http.Error(w, "无效的uri: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 	// 2) Dial 到后端：过滤会由 Dialer 自动设置/可能导致重复的头
 	//    注意：必须使用 Canonical 形式（Sec-Websocket-Key 等）
 	skip := canonicalSet(
@@ -221,11 +332,21 @@ func forwardWebSocket(w http.ResponseWriter, r *http.Request, targetURI string)
 		"Sec-WebSocket-Protocol", // 协议列表单独处理
 		"Host",                   // 让 Dialer 根据 URL 设置
 	)
+	// 逐跳头、客户端认证头和转发头不透传
+	for _, h := range slices.Concat(hopHeaders, clientAuthHeaders) {
+		skip[http.CanonicalHeaderKey(h)] = struct{}{}
+	}
 
 	backendHeaders := http.Header{}
 	// 透传头
-	r.Header.Set("X-Security-Key", config.GetProxy().XSecurityKey)
 	copyHeaders(backendHeaders, r.Header, skip)
+	setForwardedHeaders(backendHeaders, r)
+	setUserHeader(backendHeaders, r)
+	setRequestIdHeader(backendHeaders, r)
+	if err := signRequest(backendHeaders, http.MethodGet, wsURL, nil); err != nil {
+		http.Error(w, "请求签名失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	// 可选：把客户端请求的子协议传给后端（但不要放到 header，交给 Dialer.Subprotocols）
 	var subprotocols []string
@@ -237,15 +358,15 @@ func forwardWebSocket(w http.ResponseWriter, r *http.Request, targetURI string)
 		}
 	}
 
-	dialer := websocket.Dialer{
-		Proxy:             http.ProxyFromEnvironment,
-		HandshakeTimeout:  30 * time.Second,
-		EnableCompression: false, // 避免压缩带来的复杂性
-		Subprotocols:      subprotocols,
+	dialer, err := agentDialer(target)
+	if err != nil {
+		http.Error(w, "TLS配置错误: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
+	dialer.Subprotocols = subprotocols
 	backendConn, _, err := dialer.Dial(wsURL.String(), backendHeaders)
 	if err != nil {
-		slog.Error("拨号失败...", slog.String("Err", err.Error()))
+		slog.ErrorContext(r.Context(), "拨号失败...", slog.String("Err", err.Error()))
 		http.Error(w, "拨号agent失败: "+err.Error(), http.StatusBadGateway)
 		return
 	}
@@ -262,25 +383,29 @@ func forwardWebSocket(w http.ResponseWriter, r *http.Request, targetURI string)
 		return
 	}
 	defer clientConn.Close()
+	// 登记会话, proxy关闭时通知客户端
+	session := wsSessions.add(clientConn)
+	defer wsSessions.remove(session)
 
 	// 4) 双向转发
 	errc := make(chan error, 2)
 
-	go proxyCopy(errc, clientConn, backendConn) // client -> backend
-	go proxyCopy(errc, backendConn, clientConn) // backend -> client
+	go proxyCopy(errc, clientConn, backendConn.WriteMessage, tap.fromClient) // client -> backend
+	go proxyCopy(errc, backendConn, session.writeClient, tap.fromBackend)    // backend -> client
 
 	<-errc // 任一方向断开就退出
 }
 
-// proxyCopy websocket数据双向转发
-func proxyCopy(errc chan<- error, src, dst *websocket.Conn) {
+// proxyCopy websocket数据双向转发, tap 用于截取消息(审计)
+func proxyCopy(errc chan<- error, src *websocket.Conn, write func(int, []byte) error, tap func([]byte)) {
 	for {
 		mt, msg, err := src.ReadMessage()
 		if err != nil {
 			errc <- err
 			return
 		}
-		if err := dst.WriteMessage(mt, msg); err != nil {
+		tap(msg)
+		if err := write(mt, msg); err != nil {
 			errc <- err
 			return
 		}
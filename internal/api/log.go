@@ -0,0 +1,96 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"cmder/internal/logging"
+
+	"github.com/google/uuid"
+)
+
+// requestIdHeader 请求ID, proxy转发到agent时携带, 用于关联两端的日志和审计记录
+const requestIdHeader = "X-Request-ID"
+
+const requestIdCtxKey ctxKey = tokenCtxKey + 1
+
+// requestId 获取请求ID
+func requestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdCtxKey).(string)
+	return id
+}
+
+// setRequestIdHeader 将请求ID传递给agent
+func setRequestIdHeader(h http.Header, r *http.Request) {
+	if id := requestId(r); id != "" {
+		h.Set(requestIdHeader, id)
+	}
+}
+
+// validRequestId 客户端或proxy传入的请求ID只接受长度有限的常见字符, 避免污染日志
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	return strings.IndexFunc(id, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c))
+	}) < 0
+}
+
+// RequestLog 中间件：沿用请求头中的请求ID或生成新的请求ID, 将请求ID、目标主机、任务ID写入日志上下文,
+// 请求结束后记录一行访问日志. 处理过程中用 slog.XxxContext(r.Context(), ...) 输出的日志都带有这些属性, 用户在登录校验后追加
+// 响应头中返回请求ID, 错误响应的正文末尾也附加请求ID
+func RequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIdHeader)
+		if !validRequestId(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(requestIdHeader, id)
+		attrs := []slog.Attr{slog.String("RequestId", id)}
+		q := r.URL.Query()
+		if name := q.Get("name"); name != "" {
+			attrs = append(attrs, slog.String("Target", name))
+		}
+		if taskId := q.Get("task_id"); taskId != "" {
+			attrs = append(attrs, slog.String("TaskId", taskId))
+		}
+		ctx := logging.With(context.WithValue(r.Context(), requestIdCtxKey, id), attrs...)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		// http.Error 生成的错误响应; 转发的agent响应中已经包含请求ID时不重复添加
+		if sw.status >= http.StatusBadRequest && strings.HasPrefix(sw.Header().Get("Content-Type"), "text/plain") &&
+			sw.Header().Get("Content-Length") == "" && !bytes.Contains(sw.body, []byte(id)) {
+			fmt.Fprintf(sw.ResponseWriter, "请求ID: %s\n", id)
+		}
+
+		status := sw.status
+		switch {
+		case status == 0 && isWebSocketRequest(r):
+			status = http.StatusSwitchingProtocols
+		case status == 0:
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelWarn
+		case r.URL.Path == "/metrics":
+			// 监控抓取频繁, 默认不输出
+			level = slog.LevelDebug
+		}
+		slog.Log(ctx, level, "请求", slog.String("Method", r.Method), slog.String("Uri", r.URL.Path),
+			slog.String("IP", extractIP(r)), slog.Int("Status", status), slog.Duration("Duration", time.Since(start)))
+	})
+}
+
+// logAttrs 向请求的日志上下文追加属性, 如创建任务后得到的任务ID
+func logAttrs(r *http.Request, attrs ...slog.Attr) {
+	logging.Add(r.Context(), attrs...)
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"cmder/internal/config"
+	"cmder/internal/metrics"
+)
+
+// 监控指标, 由 RegisterAgentMetrics / RegisterProxyMetrics 注册后在 /metrics 输出
+var (
+	taskDuration     = metrics.NewHistogram("cmder_agent_task_duration_seconds", "任务运行时长", metrics.DefBuckets, "kind")
+	taskExits        = metrics.NewCounter("cmder_agent_task_exits_total", "任务退出次数, code 为退出码", "kind", "code")
+	commandsRejected = metrics.NewCounter("cmder_agent_commands_rejected_total", "拒绝的命令数量", "reason")
+	forwardRequests  = metrics.NewCounter("cmder_proxy_forward_requests_total", "转发到agent的请求数量", "target", "status")
+	forwardDuration  = metrics.NewHistogram("cmder_proxy_forward_duration_seconds", "转发请求耗时", metrics.DefBuckets, "target")
+	authFailures     = metrics.NewCounter("cmder_auth_failures_total", "认证失败次数(签名、登录、令牌、白名单)", "reason")
+	rateLimited      = metrics.NewCounter("cmder_rate_limited_total", "被限流拒绝的请求数量")
+
+	// runningScripts 正在运行的脚本(不占用任务数量)
+	runningScripts atomic.Int64
+)
+
+// RegisterProxyMetrics 注册proxy的指标
+func RegisterProxyMetrics() {
+	metrics.Register(forwardRequests, forwardDuration, authFailures, rateLimited)
+}
+
+// RegisterAgentMetrics 注册agent的指标, 包括任务相关的gauge
+func RegisterAgentMetrics() {
+	metrics.Register(taskDuration, taskExits, commandsRejected, authFailures, rateLimited)
+	metrics.Register(metrics.NewGaugeFunc("cmder_agent_tasks", "任务数量, queued 为已添加未开始, running 为运行中, lost 为重启后进程已不存在", []string{"state"}, func(emit func(float64, ...string)) {
+		queued, running := tasks.Count()
+		emit(float64(queued), "queued")
+		emit(float64(running), "running")
+		emit(float64(len(tasks.Lost())), "lost")
+	}))
+	metrics.Register(metrics.NewGaugeFunc("cmder_agent_task_limit", "允许的最大任务数量(taskNum)", nil, func(emit func(float64, ...string)) {
+		emit(float64(config.GetAgent().TaskNum))
+	}))
+	metrics.Register(metrics.NewGaugeFunc("cmder_agent_scripts_running", "正在运行的脚本数量", nil, func(emit func(float64, ...string)) {
+		emit(float64(runningScripts.Load()))
+	}))
+	metrics.Register(metrics.NewGaugeFunc("cmder_agent_ws_clients", "每个任务连接的WebSocket客户端数量", []string{"task_id"}, func(emit func(float64, ...string)) {
+		for id, n := range tasks.Clients() {
+			emit(float64(n), id)
+		}
+	}))
+}
+
+// observeExit 记录任务退出
+func observeExit(kind string, seconds float64, code *int) {
+	taskDuration.Observe(seconds, kind)
+	c := "unknown"
+	if code != nil {
+		c = strconv.Itoa(*code)
+	}
+	taskExits.Inc(kind, c)
+}
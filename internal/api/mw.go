@@ -2,26 +2,21 @@ package api
 
 import (
 	"cmder/internal/config"
+	"log/slog"
 	"net/http"
 	"time"
 )
 
-// Key 中间件：校验 X-Security-Key
-func Key(provider config.KeyProvider, next http.HandlerFunc) http.HandlerFunc {
+// IpCheck 验证ip黑名单、封禁和白名单, 不在白名单中计为一次失败
+func IpCheck(provider config.WhiteListProvider, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		key := r.Header.Get("X-Security-Key")
-		if key != provider.GetXSecurityKey() {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if reason, blocked := bans.Blocked(extractIP(r)); blocked {
+			slog.WarnContext(r.Context(), "拒绝访问", slog.String("IP", extractIP(r)), slog.String("Reason", reason))
+			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
-		next(w, r)
-	}
-}
-
-// IpCheck 验证ip白名单
-func IpCheck(provider config.WhiteListProvider, next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
 		if !iPInWhiteList(provider, r) {
+			bans.Fail(r, "不在白名单")
 			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
@@ -30,15 +25,17 @@ func IpCheck(provider config.WhiteListProvider, next http.HandlerFunc) http.Hand
 }
 
 // TimeRestricted 接口时间段控制访问
+// 不在允许的时间段时返回403和Retry-After, 并提示下次开放的时间; 处于紧急访问中的用户不受限制(需放在Login之后)
 func TimeRestricted(provider config.TimeRestrictedProvider, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		schedule := newSchedule(provider.GetAccess())
 		now := time.Now()
-		todayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-		currentTime := now.Sub(todayStart)
-		if currentTime < provider.GetAcStartTime() || currentTime > provider.GetAcEndTime() {
-			http.Error(w, "服务暂时不可用", http.StatusForbidden)
+		if schedule.open(now) || breakGlassActive(r) {
+			next.ServeHTTP(w, r)
 			return
 		}
-		next.ServeHTTP(w, r)
+		msg, reopen := closedMessage(r, "当前不在允许访问的时间段", schedule, now)
+		retryAfter(w, reopen, now)
+		http.Error(w, msg, http.StatusForbidden)
 	}
 }
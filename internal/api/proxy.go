@@ -1,12 +1,19 @@
 package api
 
 import (
+	"bytes"
 	_ "embed"
 	"encoding/json"
+	"errors"
+	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 	"text/template"
+	"time"
 
+	"cmder/internal/audit"
 	"cmder/internal/config"
 )
 
@@ -35,34 +42,106 @@ func Index(w http.ResponseWriter, r *http.Request) {
 // Forward 请求转发接口
 func Forward(w http.ResponseWriter, r *http.Request) {
 	targetName := r.URL.Query().Get("name")
-	var targetURI string
-	for _, t := range config.GetProxy().Targets {
-		if t.Name == targetName {
-			targetURI = t.Address
-			break
+	target, ok := findTarget(targetName)
+	if !ok {
+		http.Error(w, "目标主机未配置到", http.StatusNotFound)
+		return
+	}
+	// 校验target后再限流, 按target限流时只会为配置的target创建令牌桶
+	if limited(config.CurrentProxy, w, r) {
+		return
+	}
+	// 权限校验
+	action, known := forwardActions[r.URL.Path]
+	if (known && !allowed(r, targetName, action)) || (!known && !isAdmin(r)) {
+		slog.WarnContext(r.Context(), "没有权限", slog.String("Uri", r.URL.Path))
+		auditLog(r, audit.Record{Action: "forward.deny", Status: http.StatusForbidden, Error: "没有权限: " + r.URL.Path})
+		http.Error(w, "没有权限", http.StatusForbidden)
+		return
+	}
+	rec := audit.Record{Action: "forward" + strings.ReplaceAll(strings.TrimPrefix(r.URL.Path, "/api"), "/", ".")}
+	// 新增命令时读取命令文本用于变更窗口检查和审计
+	hasCommand := false
+	if !isWebSocketRequest(r) && r.Method == http.MethodPost && r.Body != nil {
+		// 与转发时的签名使用同一个上限, 超过时拒绝而不是截断后转发
+		body, err := readBody(r)
+		if errors.Is(err, ErrBodyTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "读取请求失败: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var req struct {
+			Cmd string `json:"cmd"`
 		}
+		_ = json.Unmarshal(body, &req)
+		rec.Command, hasCommand = req.Cmd, true
 	}
-	if targetURI == "" {
-		http.Error(w, "目标主机未配置到", http.StatusNotFound)
+	// 访问时间和变更窗口
+	if msg, reopen, ok := checkChangeWindow(r, targetName, action, rec.Command, hasCommand); !ok {
+		slog.WarnContext(r.Context(), "不在变更窗口", slog.String("Uri", r.URL.Path))
+		auditLog(r, audit.Record{Action: "change.deny", Command: rec.Command, Status: http.StatusForbidden, Error: msg})
+		retryAfter(w, reopen, time.Now())
+		http.Error(w, msg, http.StatusForbidden)
 		return
 	}
+	start := time.Now()
 	if isWebSocketRequest(r) {
-		slog.Info("代理转发websocket请求...", slog.String("Uri", r.URL.Path))
-		forwardWebSocket(w, r, targetURI)
+		slog.InfoContext(r.Context(), "代理转发websocket请求...", slog.String("Uri", r.URL.Path))
+		tap := &wsTap{}
+		forwardWebSocket(w, r, target, tap)
+		rec.TaskId, rec.Command = tap.result()
+		if rec.TaskId == "" {
+			rec.TaskId = r.URL.Query().Get("task_id")
+		}
 	} else {
-		slog.Info("代理转发http请求...", slog.String("Uri", r.URL.Path))
-		forwardHTTP(w, r, targetURI)
+		slog.InfoContext(r.Context(), "代理转发http请求...", slog.String("Uri", r.URL.Path))
+		sw := &statusWriter{ResponseWriter: w}
+		forwardHTTP(sw, r, target)
+		rec.Status = sw.status
+		rec.TaskId = taskIdFrom(sw.body)
+	}
+	rec.DurationMs = time.Since(start).Milliseconds()
+	if rec.TaskId != "" {
+		logAttrs(r, slog.String("TaskId", rec.TaskId))
 	}
+	auditLog(r, rec)
+	// websocket的耗时是整个会话时长, 不计入请求耗时
+	status := "ws"
+	if rec.Status != 0 {
+		status = strconv.Itoa(rec.Status)
+		forwardDuration.Observe(time.Since(start).Seconds(), targetName)
+	}
+	forwardRequests.Inc(targetName, status)
 }
 
-// targets 获取target列表
+// findTarget 根据名称查找target
+func findTarget(name string) (config.Target, bool) {
+	for _, t := range config.GetProxy().Targets {
+		if t.Name == name && t.Address != "" {
+			return t, true
+		}
+	}
+	return config.Target{}, false
+}
 
+// Targets 获取target列表
+// 只返回请求用户有权限查看的target, permissions 为每个target上允许的操作
 func Targets(w http.ResponseWriter, r *http.Request) {
-	var targets []string
+	targets := []string{}
+	permissions := map[string][]string{}
 	for _, target := range config.GetProxy().Targets {
+		if !allowed(r, target.Name, config.ActionView) {
+			continue
+		}
 		targets = append(targets, target.Name)
+		permissions[target.Name] = allowedActions(r, target.Name)
 	}
 	_ = json.NewEncoder(w).Encode(map[string]any{
-		"targets": targets,
+		"targets":     targets,
+		"permissions": permissions,
 	})
 }
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"container/list"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cmder/internal/config"
+)
+
+// maxBuckets 令牌桶数量上限, 超过时淘汰最久未使用的桶(被淘汰的桶再次请求时重新补满)
+const maxBuckets = 10000
+
+// limiter 所有限流规则的令牌桶
+var limiter = newRateLimiter(maxBuckets)
+
+// bucket 令牌桶
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+	full   time.Time // 令牌补满的时间, 之后删除该桶与保留它等价
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	size      int
+	buckets   map[string]*list.Element
+	lru       *list.List // 最近使用的桶在前
+	lastSweep time.Time
+}
+
+func newRateLimiter(size int) *rateLimiter {
+	return &rateLimiter{size: size, buckets: make(map[string]*list.Element), lru: list.New()}
+}
+
+// take 从桶中取一个令牌, 不足时返回需要等待的时间
+func (l *rateLimiter) take(key string, rule config.RateLimit, now time.Time) time.Duration {
+	rate := float64(rule.Requests) / rule.Per.Seconds() // 每秒补充的令牌数
+	burst := float64(rule.Burst)
+	if burst <= 0 {
+		burst = float64(rule.Requests)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	var b *bucket
+	if e, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*bucket)
+	} else {
+		if l.lru.Len() >= l.size {
+			l.remove(l.lru.Back())
+		}
+		b = &bucket{key: key, tokens: burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	var wait time.Duration
+	if b.tokens >= 1 {
+		b.tokens--
+	} else {
+		wait = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.full = now.Add(time.Duration((burst - b.tokens) / rate * float64(time.Second)))
+	return wait
+}
+
+// sweep 清理已经补满的桶, 再次请求时会重新创建一个满的桶, 调用方需持有锁
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for e := l.lru.Front(); e != nil; {
+		next := e.Next()
+		if !now.Before(e.Value.(*bucket).full) {
+			l.remove(e)
+		}
+		e = next
+	}
+}
+
+func (l *rateLimiter) remove(e *list.Element) {
+	delete(l.buckets, e.Value.(*bucket).key)
+	l.lru.Remove(e)
+}
+
+// routeMatch 请求是否匹配规则的路由: [方法 ]路径前缀
+func routeMatch(route string, r *http.Request) bool {
+	if route == "" {
+		return true
+	}
+	if method, path, ok := strings.Cut(route, " "); ok {
+		if !strings.EqualFold(method, r.Method) {
+			return false
+		}
+		route = strings.TrimSpace(path)
+	}
+	return strings.HasPrefix(r.URL.Path, route)
+}
+
+// limitKey 根据规则的维度生成桶的键
+func limitKey(i int, rule config.RateLimit, r *http.Request) string {
+	parts := []string{strconv.Itoa(i), rule.Route}
+	for _, by := range rule.By {
+		switch by {
+		case config.LimitByIP:
+			parts = append(parts, "ip="+extractIP(r))
+		case config.LimitByUser:
+			if user := requestUser(r); user != "" {
+				parts = append(parts, "user="+user)
+			} else {
+				parts = append(parts, "ip="+extractIP(r))
+			}
+		case config.LimitByTarget:
+			parts = append(parts, "target="+r.URL.Query().Get("name"))
+		}
+	}
+	return strings.Join(parts, "|")
+}
+
+// RateLimit 中间件：按IP、用户和target限流, 超出时返回429
+// 按用户限流时需要放在 Login/Key 之后
+func RateLimit(provider config.RateLimitProvider, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limited(provider, w, r) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// limited 按匹配的规则取令牌, 超出时返回429并返回true
+func limited(provider config.RateLimitProvider, w http.ResponseWriter, r *http.Request) bool {
+	now := time.Now()
+	var wait time.Duration
+	for i, rule := range provider.GetRateLimits() {
+		if !routeMatch(rule.Route, r) {
+			continue
+		}
+		wait = max(wait, limiter.take(limitKey(i, rule, r), rule, now))
+	}
+	if wait == 0 {
+		return false
+	}
+	slog.WarnContext(r.Context(), "请求过于频繁", slog.String("IP", extractIP(r)), slog.String("Uri", r.URL.Path))
+	rateLimited.Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "请求过于频繁, 请稍后再试", http.StatusTooManyRequests)
+	return true
+}
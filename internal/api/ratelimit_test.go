@@ -0,0 +1,41 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"cmder/internal/config"
+)
+
+func TestRateLimiterBounded(t *testing.T) {
+	rule := config.RateLimit{Requests: 1, Per: time.Minute}
+	l := newRateLimiter(2)
+	now := time.Now()
+
+	if wait := l.take("a", rule, now); wait != 0 {
+		t.Fatalf("first request waited %s", wait)
+	}
+	if wait := l.take("a", rule, now); wait == 0 {
+		t.Fatal("second request not limited")
+	}
+	l.take("b", rule, now)
+	l.take("a", rule, now)
+	// 超过上限时淘汰最久未使用的b, a仍然受限
+	l.take("c", rule, now)
+	if len(l.buckets) != 2 || l.lru.Len() != 2 {
+		t.Fatalf("buckets = %d, want 2", len(l.buckets))
+	}
+	if _, ok := l.buckets["b"]; ok {
+		t.Fatal("least recently used bucket not evicted")
+	}
+	if wait := l.take("a", rule, now); wait == 0 {
+		t.Fatal("recently used bucket evicted")
+	}
+
+	// 补满后清理
+	later := now.Add(2 * time.Minute)
+	l.sweep(later)
+	if len(l.buckets) != 0 || l.lru.Len() != 0 {
+		t.Fatalf("refilled buckets not swept: %d", len(l.buckets))
+	}
+}
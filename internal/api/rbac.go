@@ -0,0 +1,130 @@
+package api
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"cmder/internal/config"
+)
+
+// forwardActions agent接口对应的权限操作, 未列出的接口只允许管理员访问
+var forwardActions = map[string]string{
+	"/api/cmd/add":    config.ActionCmd,
+	"/api/cmd/out":    config.ActionView,
+	"/api/cmd/ids":    config.ActionView,
+	"/api/cmd/runws":  config.ActionScript,
+	"/api/cmd/kill":   config.ActionKill,
+	"/api/cmd/upload": config.ActionUpload,
+}
+
+// allActions 全部可授权操作
+var allActions = []string{config.ActionView, config.ActionCmd, config.ActionScript, config.ActionKill, config.ActionUpload}
+
+// rbacEnabled 启用登录并配置了角色时才做权限控制
+func rbacEnabled() bool {
+	return authEnabled() && len(config.GetProxy().Roles) > 0
+}
+
+// userRoles 获取请求用户的角色配置
+func userRoles(r *http.Request) []config.Role {
+	names := users.Roles(requestUser(r))
+	var roles []config.Role
+	for _, role := range config.GetProxy().Roles {
+		if slices.Contains(names, role.Name) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// isAdmin 请求用户是否为管理员
+func isAdmin(r *http.Request) bool {
+	if requestToken(r) != nil {
+		return false
+	}
+	if !rbacEnabled() {
+		return true
+	}
+	for _, role := range userRoles(r) {
+		if role.Admin {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminOnly 中间件：只允许管理员访问
+func AdminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			http.Error(w, "没有权限", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// allowed 请求用户是否可以对target执行action
+// 拥有任一操作权限即可查看该target(view)
+func allowed(r *http.Request, target, action string) bool {
+	// API令牌只按令牌自身的范围授权
+	if t := requestToken(r); t != nil {
+		return t.allows(target, action)
+	}
+	if !rbacEnabled() {
+		return true
+	}
+	groups := targetGroups(target)
+	for _, role := range userRoles(r) {
+		if role.Admin {
+			return true
+		}
+		for _, rule := range role.Rules {
+			if !ruleHasTarget(rule, target, groups) {
+				continue
+			}
+			if action == config.ActionView && len(rule.Actions) > 0 {
+				return true
+			}
+			if slices.Contains(rule.Actions, action) || slices.Contains(rule.Actions, "*") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowedActions 请求用户在target上拥有的操作, 用于页面展示
+func allowedActions(r *http.Request, target string) []string {
+	actions := []string{}
+	for _, action := range allActions {
+		if allowed(r, target, action) {
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
+
+// ruleHasTarget 规则是否包含target
+func ruleHasTarget(rule config.Rule, target string, groups []string) bool {
+	for _, t := range rule.Targets {
+		if t == "*" || t == target {
+			return true
+		}
+		if group, ok := strings.CutPrefix(t, "group:"); ok && slices.Contains(groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetGroups 获取target所属分组
+func targetGroups(name string) []string {
+	for _, t := range config.GetProxy().Targets {
+		if t.Name == name {
+			return t.Groups
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"log/slog"
+
+	"cmder/internal/config"
+	"cmder/internal/logging"
+)
+
+// ReloadAgent 重新加载agent配置并更新依赖配置的组件
+// 监听地址、超时、TLS证书和审计日志配置需要重启后生效, 正在运行的任务不受影响
+func ReloadAgent() error {
+	changes, err := config.ReloadAgent()
+	if err != nil {
+		return err
+	}
+	c := config.GetAgent()
+	if err := logging.Setup(c.GetLog()); err != nil {
+		return err
+	}
+	if err := InitTrustedProxies(c); err != nil {
+		return err
+	}
+	if err := InitBan(c); err != nil {
+		return err
+	}
+	logChanges(changes)
+	return nil
+}
+
+// ReloadProxy 重新加载proxy配置并更新依赖配置的组件
+// 监听地址、超时、TLS证书和审计日志配置需要重启后生效
+func ReloadProxy() error {
+	changes, err := config.ReloadProxy()
+	if err != nil {
+		return err
+	}
+	c := config.GetProxy()
+	if err := logging.Setup(c.GetLog()); err != nil {
+		return err
+	}
+	if err := InitTrustedProxies(c); err != nil {
+		return err
+	}
+	if err := InitBan(c); err != nil {
+		return err
+	}
+	if err := InitBreakGlass(c); err != nil {
+		return err
+	}
+	// target地址或证书可能已变化, 重新建立连接
+	agentConns.Range(func(name, c any) bool {
+		agentConns.Delete(name)
+		c.(*agentConn).client.CloseIdleConnections()
+		return true
+	})
+	logChanges(changes)
+	return nil
+}
+
+func logChanges(changes []string) {
+	if len(changes) == 0 {
+		slog.Info("配置已重新加载, 没有变化")
+		return
+	}
+	slog.Info("配置已重新加载", slog.Int("Changes", len(changes)))
+	for _, c := range changes {
+		slog.Info("配置变更", slog.String("Change", c))
+	}
+}
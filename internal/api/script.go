@@ -0,0 +1,455 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cmder/internal/audit"
+	"cmder/internal/config"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrScriptNotFound = errors.New("脚本不存在")
+	ErrScriptName     = errors.New("脚本名只能包含字母、数字、下划线、中划线和点, 且不能以点开头")
+
+	scriptNameRe = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+	scripts      = &scriptStore{}
+)
+
+// scriptVersion 脚本的一个版本
+type scriptVersion struct {
+	Version int       `json:"version"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+// scriptInfo 脚本及其所有版本
+type scriptInfo struct {
+	Name     string          `json:"name"`
+	Latest   int             `json:"latest"`
+	Versions []scriptVersion `json:"versions"`
+}
+
+// scriptStore 脚本库, 按 <scriptDir>/<脚本名>/<版本号>.sh 保存在磁盘上
+type scriptStore struct {
+	mu sync.RWMutex
+}
+
+func (s *scriptStore) dir() string {
+	return config.GetProxy().GetScriptDir()
+}
+
+// versions 读取脚本的版本列表(升序)
+func (s *scriptStore) versions(name string) ([]scriptVersion, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir(), name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrScriptNotFound
+		}
+		return nil, err
+	}
+	var vs []scriptVersion
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sh") {
+			continue
+		}
+		v, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".sh"))
+		if err != nil || v <= 0 {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		vs = append(vs, scriptVersion{Version: v, Size: info.Size(), Created: info.ModTime()})
+	}
+	if len(vs) == 0 {
+		return nil, ErrScriptNotFound
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i].Version < vs[j].Version })
+	return vs, nil
+}
+
+// List 列出所有脚本
+func (s *scriptStore) List() ([]scriptInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries, err := os.ReadDir(s.dir())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []scriptInfo{}, nil
+		}
+		return nil, err
+	}
+	list := make([]scriptInfo, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() || !scriptNameRe.MatchString(e.Name()) {
+			continue
+		}
+		vs, err := s.versions(e.Name())
+		if err != nil {
+			continue
+		}
+		list = append(list, scriptInfo{Name: e.Name(), Latest: vs[len(vs)-1].Version, Versions: vs})
+	}
+	return list, nil
+}
+
+// Info 获取单个脚本的版本信息
+func (s *scriptStore) Info(name string) (*scriptInfo, error) {
+	if !scriptNameRe.MatchString(name) {
+		return nil, ErrScriptName
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	vs, err := s.versions(name)
+	if err != nil {
+		return nil, err
+	}
+	return &scriptInfo{Name: name, Latest: vs[len(vs)-1].Version, Versions: vs}, nil
+}
+
+// Get 读取脚本内容, version<=0 时读取最新版本
+func (s *scriptStore) Get(name string, version int) (int, string, error) {
+	if !scriptNameRe.MatchString(name) {
+		return 0, "", ErrScriptName
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if version <= 0 {
+		vs, err := s.versions(name)
+		if err != nil {
+			return 0, "", err
+		}
+		version = vs[len(vs)-1].Version
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir(), name, strconv.Itoa(version)+".sh"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, "", ErrScriptNotFound
+		}
+		return 0, "", err
+	}
+	return version, string(data), nil
+}
+
+// Save 保存脚本的新版本, 返回新版本号
+func (s *scriptStore) Save(name, content string) (int, error) {
+	if !scriptNameRe.MatchString(name) {
+		return 0, ErrScriptName
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir := filepath.Join(s.dir(), name)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return 0, err
+	}
+	version := 1
+	if vs, err := s.versions(name); err == nil {
+		version = vs[len(vs)-1].Version + 1
+	}
+	// 先写临时文件再重命名, 避免读到写了一半的脚本
+	path := filepath.Join(dir, strconv.Itoa(version)+".sh")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o640); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return 0, err
+	}
+	return version, nil
+}
+
+// Delete 删除脚本的指定版本, version<=0 时删除整个脚本
+func (s *scriptStore) Delete(name string, version int) error {
+	if !scriptNameRe.MatchString(name) {
+		return ErrScriptName
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir := filepath.Join(s.dir(), name)
+	if version <= 0 {
+		if _, err := os.Stat(dir); err != nil {
+			return ErrScriptNotFound
+		}
+		return os.RemoveAll(dir)
+	}
+	if err := os.Remove(filepath.Join(dir, strconv.Itoa(version)+".sh")); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrScriptNotFound
+		}
+		return err
+	}
+	// 最后一个版本删除后清理目录
+	if _, err := s.versions(name); errors.Is(err, ErrScriptNotFound) {
+		_ = os.RemoveAll(dir)
+	}
+	return nil
+}
+
+// scriptError 将脚本库错误转换为http状态码
+func scriptError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrScriptNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrScriptName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "脚本库操作失败: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// queryVersion 解析请求中的version参数, 未指定时返回0
+func queryVersion(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("version")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("无效的版本号: %s", v)
+	}
+	return n, nil
+}
+
+// ListScripts 列出脚本库中的脚本
+func ListScripts(w http.ResponseWriter, r *http.Request) {
+	list, err := scripts.List()
+	if err != nil {
+		scriptError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"scripts": list})
+}
+
+// GetScript 获取脚本, 带version参数时返回该版本内容, 否则返回最新版本内容及版本列表
+func GetScript(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	version, err := queryVersion(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info, err := scripts.Info(name)
+	if err != nil {
+		scriptError(w, err)
+		return
+	}
+	version, content, err := scripts.Get(name, version)
+	if err != nil {
+		scriptError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"name":     name,
+		"version":  version,
+		"content":  content,
+		"versions": info.Versions,
+	})
+}
+
+// SaveScript 新增脚本或为已有脚本保存新版本
+// 脚本库对所有target共享, 只有管理员可以修改(由路由上的 AdminOnly 保证)
+func SaveScript(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name    string `json:"name"`
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "请求参数错误", http.StatusBadRequest)
+		return
+	}
+	if r.PathValue("name") != "" {
+		req.Name = r.PathValue("name")
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		http.Error(w, "脚本内容不能为空", http.StatusBadRequest)
+		return
+	}
+	version, err := scripts.Save(req.Name, req.Content)
+	if err != nil {
+		scriptError(w, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "保存脚本", slog.String("Name", req.Name), slog.Int("Version", version))
+	auditLog(r, audit.Record{Action: "script.save", Script: fmt.Sprintf("%s@%d", req.Name, version), Command: req.Content})
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]any{"name": req.Name, "version": version})
+}
+
+// DeleteScript 删除脚本, 带version参数时只删除该版本
+func DeleteScript(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	version, err := queryVersion(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := scripts.Delete(name, version); err != nil {
+		scriptError(w, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "删除脚本", slog.String("Name", name), slog.Int("Version", version))
+	auditLog(r, audit.Record{Action: "script.delete", Script: fmt.Sprintf("%s@%d", name, version)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// scriptResult 脚本在单个target上的执行结果
+type scriptResult struct {
+	Target string   `json:"target"`
+	TaskId string   `json:"task_id,omitempty"`
+	Output []string `json:"output"`
+	// Truncated 输出超过 scriptRun.maxOutput, 之后的部分被丢弃
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// RunScript 在一个或多个target上执行脚本库中的脚本
+// 脚本通过agent的 /api/cmd/runws 接口下发, agent端无需改动
+func RunScript(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var req struct {
+		Version int      `json:"version"`
+		Targets []string `json:"targets"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "请求参数错误", http.StatusBadRequest)
+		return
+	}
+	if len(req.Targets) == 0 {
+		http.Error(w, "目标主机不能为空", http.StatusBadRequest)
+		return
+	}
+	limits := config.GetProxy().ScriptRun
+	if len(req.Targets) > limits.MaxTargets {
+		http.Error(w, fmt.Sprintf("目标主机过多, 单次最多 %d 个", limits.MaxTargets), http.StatusBadRequest)
+		return
+	}
+	version, content, err := scripts.Get(name, req.Version)
+	if err != nil {
+		scriptError(w, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "执行脚本", slog.String("Name", name), slog.Int("Version", version), slog.Any("Targets", req.Targets))
+
+	results := make([]scriptResult, len(req.Targets))
+	var wg sync.WaitGroup
+	for i, target := range req.Targets {
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+			if !allowed(r, target, config.ActionScript) {
+				results[i] = scriptResult{Target: target, Output: []string{}, Error: "没有权限"}
+				auditLog(r, audit.Record{Action: "script.deny", Target: target, Script: fmt.Sprintf("%s@%d", name, version), Status: http.StatusForbidden})
+				return
+			}
+			if msg, _, ok := checkChangeWindow(r, target, config.ActionScript, content, true); !ok {
+				results[i] = scriptResult{Target: target, Output: []string{}, Error: msg}
+				auditLog(r, audit.Record{Action: "change.deny", Target: target, Script: fmt.Sprintf("%s@%d", name, version), Status: http.StatusForbidden, Error: msg})
+				return
+			}
+			start := time.Now()
+			results[i] = runScriptOn(r, target, content, limits.MaxOutput<<10)
+			auditLog(r, audit.Record{
+				Action:     "script.run",
+				Target:     target,
+				Script:     fmt.Sprintf("%s@%d", name, version),
+				Command:    content,
+				TaskId:     results[i].TaskId,
+				DurationMs: time.Since(start).Milliseconds(),
+				Error:      results[i].Error,
+			})
+		}(i, target)
+	}
+	wg.Wait()
+
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"name":    name,
+		"version": version,
+		"results": results,
+	})
+}
+
+// runScriptOn 连接target的runws接口, 发送脚本并收集输出直到agent关闭连接
+// 输出超过 maxOutput 字节后继续读取但不再保存, 以免中断脚本
+func runScriptOn(r *http.Request, target, content string, maxOutput int) scriptResult {
+	res := scriptResult{Target: target, Output: []string{}}
+	t, ok := findTarget(target)
+	if !ok {
+		res.Error = "目标主机未配置到"
+		return res
+	}
+	wsURL, err := wsTargetURL(t.Address, "/api/cmd/runws", "name="+target)
+	if err != nil {
+		res.Error = "无效的uri: " + err.Error()
+		return res
+	}
+	header := http.Header{}
+	setForwardedHeaders(header, r)
+	setUserHeader(header, r)
+	setRequestIdHeader(header, r)
+	if err := signRequest(header, http.MethodGet, wsURL, nil); err != nil {
+		res.Error = "请求签名失败: " + err.Error()
+		return res
+	}
+	dialer, err := agentDialer(t)
+	if err != nil {
+		res.Error = "TLS配置错误: " + err.Error()
+		return res
+	}
+	conn, _, err := dialer.DialContext(r.Context(), wsURL.String(), header)
+	if err != nil {
+		res.Error = "拨号agent失败: " + err.Error()
+		return res
+	}
+	defer conn.Close()
+
+	// agent首先返回task_id
+	var started struct {
+		TaskId string `json:"task_id"`
+	}
+	if err := conn.ReadJSON(&started); err != nil {
+		res.Error = "读取任务信息失败: " + err.Error()
+		return res
+	}
+	res.TaskId = started.TaskId
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(content)); err != nil {
+		res.Error = "发送脚本失败: " + err.Error()
+		return res
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(scriptEnd)); err != nil {
+		res.Error = "发送结束信号失败: " + err.Error()
+		return res
+	}
+	size := 0
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if res.Truncated {
+			continue
+		}
+		if size += len(msg); size > maxOutput {
+			res.Truncated = true
+			res.Output = append(res.Output, fmt.Sprintf("=============== 输出超过 %d KB, 之后的内容已丢弃 ===============", maxOutput>>10))
+			continue
+		}
+		res.Output = append(res.Output, string(msg))
+	}
+	return res
+}
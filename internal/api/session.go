@@ -0,0 +1,346 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cmder/internal/audit"
+	"cmder/internal/config"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	sessionCookie = "cmder_session"
+	// userHeader proxy转发到agent时携带的操作用户
+	userHeader = "X-Cmder-User"
+)
+
+var (
+	ErrBadLogin = errors.New("用户名或密码错误")
+
+	users    = &userStore{}
+	sessions = &sessionStore{sessions: make(map[string]*session)}
+
+	// dummyHash 用户不存在时也做一次bcrypt比较, 避免通过耗时判断用户是否存在
+	dummyHash = sync.OnceValue(func() []byte {
+		hash, _ := bcrypt.GenerateFromPassword([]byte("cmder-dummy-password"), bcrypt.DefaultCost)
+		return hash
+	})
+)
+
+type ctxKey int
+
+const userCtxKey ctxKey = iota
+
+// withUser 将操作用户写入请求上下文
+func withUser(r *http.Request, user string) *http.Request {
+	logAttrs(r, slog.String("User", user))
+	return r.WithContext(context.WithValue(r.Context(), userCtxKey, user))
+}
+
+// requestUser 获取请求的操作用户, 未登录时为空
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userCtxKey).(string)
+	return user
+}
+
+// ---------------- 用户 ----------------
+
+// userEntry 用户文件中的一个用户
+type userEntry struct {
+	Name     string   `yaml:"name"`
+	Password string   `yaml:"password"` // bcrypt哈希
+	Roles    []string `yaml:"roles"`    // 角色, 定义在proxy配置中
+	Disabled bool     `yaml:"disabled"`
+}
+
+// userStore 用户文件, 文件修改后自动重新加载
+type userStore struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	users   map[string]userEntry
+}
+
+// load 文件有变化时重新读取用户文件
+func (s *userStore) load(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("读取用户文件失败: %v", err)
+	}
+	if s.path == path && info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("读取用户文件失败: %v", err)
+	}
+	var file struct {
+		Users []userEntry `yaml:"users"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("解析用户文件失败: %v", err)
+	}
+	m := make(map[string]userEntry, len(file.Users))
+	for _, u := range file.Users {
+		if u.Name == "" {
+			continue
+		}
+		m[u.Name] = u
+	}
+	s.path, s.modTime, s.users = path, info.ModTime(), m
+	slog.Info("加载用户文件", slog.String("File", path), slog.Int("Users", len(m)))
+	return nil
+}
+
+// Authenticate 校验用户名和密码
+func (s *userStore) Authenticate(name, password string) error {
+	s.mu.Lock()
+	if err := s.load(config.GetProxy().GetAuth().UsersFile); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	u, ok := s.users[name]
+	s.mu.Unlock()
+
+	if !ok || u.Disabled {
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return ErrBadLogin
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
+		return ErrBadLogin
+	}
+	return nil
+}
+
+// Active 用户是否仍然存在且未被禁用
+func (s *userStore) Active(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(config.GetProxy().GetAuth().UsersFile); err != nil {
+		slog.Error("加载用户文件失败", slog.String("Err", err.Error()))
+		return false
+	}
+	u, ok := s.users[name]
+	return ok && !u.Disabled
+}
+
+// Roles 获取用户的角色名
+func (s *userStore) Roles(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(config.GetProxy().GetAuth().UsersFile); err != nil {
+		return nil
+	}
+	return s.users[name].Roles
+}
+
+// HashPassword 生成bcrypt密码哈希, 用于填写用户文件
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// ---------------- 会话 ----------------
+
+type session struct {
+	user     string
+	created  time.Time
+	lastSeen time.Time
+}
+
+// sessionStore 内存中的登录会话, proxy重启后需要重新登录
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// Create 为用户创建会话, 返回会话令牌
+func (s *sessionStore) Create(user string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	s.sessions[token] = &session{user: user, created: now, lastSeen: now}
+	return token, nil
+}
+
+// Get 校验会话是否有效, 有效时刷新最后访问时间
+func (s *sessionStore) Get(token string) (string, bool) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[token]
+	if !ok {
+		return "", false
+	}
+	if s.expired(sess, now) {
+		delete(s.sessions, token)
+		return "", false
+	}
+	sess.lastSeen = now
+	return sess.user, true
+}
+
+// Delete 删除会话
+func (s *sessionStore) Delete(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+}
+
+func (s *sessionStore) expired(sess *session, now time.Time) bool {
+	auth := config.GetProxy().GetAuth()
+	return now.Sub(sess.created) > auth.SessionTTL || now.Sub(sess.lastSeen) > auth.IdleTimeout
+}
+
+// sweep 清理过期会话, 调用方需持有锁
+func (s *sessionStore) sweep(now time.Time) {
+	for token, sess := range s.sessions {
+		if s.expired(sess, now) {
+			delete(s.sessions, token)
+		}
+	}
+}
+
+// authEnabled 是否启用了控制台登录
+func authEnabled() bool {
+	return config.GetProxy().GetAuth().UsersFile != ""
+}
+
+// setSessionCookie 写入会话cookie, maxAge<0 表示删除
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || config.GetProxy().GetAuth().SecureCookie,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// ---------------- 中间件和接口 ----------------
+
+// Login 中间件：校验登录会话或API令牌, 并将用户名写入请求上下文
+// 页面请求未登录时跳转到登录页, 接口请求返回401
+func Login(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if raw, ok := bearerToken(r); ok {
+			t, err := tokens.Verify(raw)
+			if err != nil {
+				slog.WarnContext(r.Context(), "API令牌校验失败", slog.String("IP", extractIP(r)), slog.String("Err", err.Error()))
+				bans.Fail(r, "API令牌无效")
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next(w, withToken(r, t))
+			return
+		}
+		if !authEnabled() {
+			next(w, r)
+			return
+		}
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			if user, ok := sessions.Get(c.Value); ok && users.Active(user) {
+				next(w, withUser(r, user))
+				return
+			}
+		}
+		if !strings.HasPrefix(r.URL.Path, "/api/") && !isWebSocketRequest(r) {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// LoginPage 登录页面
+func LoginPage(w http.ResponseWriter, r *http.Request) {
+	if !authEnabled() {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(embeddedLoginHTML))
+}
+
+// DoLogin 登录接口
+func DoLogin(w http.ResponseWriter, r *http.Request) {
+	if !authEnabled() {
+		http.Error(w, "未启用登录", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "请求参数错误", http.StatusBadRequest)
+		return
+	}
+	if err := users.Authenticate(req.Username, req.Password); err != nil {
+		slog.WarnContext(r.Context(), "登录失败", slog.String("User", req.Username), slog.String("IP", extractIP(r)), slog.String("Err", err.Error()))
+		auditLog(r, audit.Record{Action: "user.login", User: req.Username, Status: http.StatusUnauthorized, Error: err.Error()})
+		if errors.Is(err, ErrBadLogin) {
+			bans.Fail(r, "登录失败")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		} else {
+			http.Error(w, "登录失败", http.StatusInternalServerError)
+		}
+		return
+	}
+	token, err := sessions.Create(req.Username)
+	if err != nil {
+		http.Error(w, "创建会话失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, token, int(config.GetProxy().GetAuth().SessionTTL.Seconds()))
+	slog.InfoContext(r.Context(), "登录成功", slog.String("User", req.Username), slog.String("IP", extractIP(r)))
+	auditLog(r, audit.Record{Action: "user.login", User: req.Username, Status: http.StatusOK})
+	_ = json.NewEncoder(w).Encode(map[string]string{"user": req.Username})
+}
+
+// Logout 退出登录
+func Logout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if user, ok := sessions.Get(c.Value); ok {
+			auditLog(r, audit.Record{Action: "user.logout", User: user})
+		}
+		sessions.Delete(c.Value)
+	}
+	setSessionCookie(w, r, "", -1)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Me 当前登录用户
+func Me(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"user":               requestUser(r),
+		"roles":              users.Roles(requestUser(r)),
+		"admin":              isAdmin(r),
+		"auth_enabled":       authEnabled(),
+		"access_open":        newSchedule(config.GetProxy().GetAccess()).open(time.Now()),
+		"break_glass":        canBreakGlass(r),
+		"break_glass_active": breakGlass.Active(requestUser(r)),
+	})
+}
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"cmder/internal/audit"
+	"cmder/internal/config"
+
+	"github.com/gorilla/websocket"
+)
+
+// killGrace 发送SIGTERM后等待进程退出的时间, 超时后发送SIGKILL
+const killGrace = 5 * time.Second
+
+var (
+	ErrDraining = errors.New("服务正在关闭, 不再接受新任务")
+
+	// draining 收到退出信号后置为true, 不再接受新任务
+	draining atomic.Bool
+
+	scriptRuns = &scriptRegistry{runs: make(map[string]*scriptRun)}
+	wsSessions = &sessionRegistry{sessions: make(map[*wsSession]struct{})}
+)
+
+// ---------------- agent ----------------
+
+// scriptRun 运行中的脚本, conn的写操作需要加锁(gorilla/websocket不支持并发写)
+type scriptRun struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+	cmd  *exec.Cmd
+}
+
+func (s *scriptRun) write(msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+// scriptRegistry 运行中的脚本, 关闭时通知客户端并终止进程组
+type scriptRegistry struct {
+	mu   sync.Mutex
+	runs map[string]*scriptRun
+}
+
+func (r *scriptRegistry) add(id string, conn *websocket.Conn, cmd *exec.Cmd) *scriptRun {
+	run := &scriptRun{conn: conn, cmd: cmd}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runs[id] = run
+	return run
+}
+
+func (r *scriptRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.runs, id)
+}
+
+func (r *scriptRegistry) snapshot() map[string]*scriptRun {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	runs := make(map[string]*scriptRun, len(r.runs))
+	for id, run := range r.runs {
+		runs[id] = run
+	}
+	return runs
+}
+
+// DrainAgent 关闭agent: 不再接受新任务, 通知已连接的客户端, 等待运行中的任务和脚本结束直到ctx结束,
+// 然后丢弃未启动的任务, 终止剩余任务的进程组, 并将每个任务的状态写入审计日志
+// 配置了 taskState.keepOnExit 时命令任务继续运行, 重启后由 RecoverTasks 接管; 脚本依赖客户端连接, 仍然等待和终止
+func DrainAgent(ctx context.Context) {
+	draining.Store(true)
+	keep := config.GetAgent().TaskState.KeepOnExit
+	queued, running := tasks.Count()
+	runs := scriptRuns.snapshot()
+	auditor.Log(audit.Record{Action: "agent.shutdown", Detail: fmt.Sprintf("queued=%d running=%d scripts=%d keep=%t", queued, running, len(runs), keep)})
+	if running > 0 || len(runs) > 0 {
+		msg := "=============== agent正在关闭, 等待任务结束 ==============="
+		if deadline, ok := ctx.Deadline(); ok {
+			msg = fmt.Sprintf("=============== agent正在关闭, %s 后终止任务 ===============", time.Until(deadline).Round(time.Second))
+		}
+		taskMsg := msg
+		if keep {
+			taskMsg = "=============== agent正在重启, 任务继续运行, 重启后可重新查看输出 ==============="
+		}
+		for _, t := range tasks.snapshot() {
+			t.mu.Lock()
+			started := t.started
+			t.mu.Unlock()
+			if started {
+				t.broadcast([]byte(taskMsg))
+			}
+		}
+		for _, run := range runs {
+			_ = run.write([]byte(msg))
+		}
+		slog.Info("等待任务结束", slog.Int("Tasks", running), slog.Int("Scripts", len(runs)), slog.Bool("KeepTasks", keep))
+		waitIdle(ctx, keep)
+	}
+
+	// 未启动的任务直接丢弃
+	for _, t := range tasks.snapshot() {
+		t.mu.Lock()
+		started := t.started
+		t.mu.Unlock()
+		if started {
+			continue
+		}
+		tasks.Delete(t.Id)
+		t.closeAll("=============== agent已关闭, 任务未运行 ===============")
+		auditor.Log(audit.Record{Action: "task.discard", ClientIP: t.clientIP, User: t.user, Command: t.command, TaskId: t.Id, RequestId: t.requestId})
+		slog.Warn("丢弃未启动的任务", slog.String("TaskId", t.Id))
+	}
+
+	// 超时仍在运行的任务和脚本终止整个进程组, 退出记录由各自的等待协程写入
+	var pgids []int
+	if keep {
+		tasks.save()
+	} else {
+		for _, t := range tasks.snapshot() {
+			terminate(t.pid, audit.Record{ClientIP: t.clientIP, User: t.user, Command: t.command, TaskId: t.Id, RequestId: t.requestId})
+			pgids = append(pgids, t.pid)
+		}
+	}
+	for id, run := range scriptRuns.snapshot() {
+		terminate(run.cmd.Process.Pid, audit.Record{TaskId: id})
+		pgids = append(pgids, run.cmd.Process.Pid)
+	}
+	if len(pgids) == 0 {
+		return
+	}
+	timer, cancel := context.WithTimeout(context.Background(), killGrace)
+	defer cancel()
+	if waitIdle(timer, keep) {
+		return
+	}
+	for _, pgid := range pgids {
+		_ = syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+	// 等待退出记录写入审计日志
+	timer, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	waitIdle(timer, keep)
+}
+
+// terminate 向任务的进程组发送SIGTERM并记录
+func terminate(pid int, rec audit.Record) {
+	if pid <= 0 {
+		return
+	}
+	err := syscall.Kill(-pid, syscall.SIGTERM)
+	rec.Action = "task.terminate"
+	rec.Detail = fmt.Sprintf("pgid=%d signal=SIGTERM", pid)
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	auditor.Log(rec)
+	slog.Warn("终止任务", slog.String("TaskId", rec.TaskId), slog.Int("Pgid", pid))
+}
+
+// waitIdle 等待所有运行中的任务和脚本结束, scriptsOnly 时只等待脚本; ctx结束时返回false
+func waitIdle(ctx context.Context, scriptsOnly bool) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if _, running := tasks.Count(); (scriptsOnly || running == 0) && len(scriptRuns.snapshot()) == 0 {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// ---------------- proxy ----------------
+
+// wsSession 一个经proxy转发的websocket会话, 写客户端连接需要加锁
+type wsSession struct {
+	mu     sync.Mutex
+	client *websocket.Conn
+}
+
+func (s *wsSession) writeClient(mt int, msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client.WriteMessage(mt, msg)
+}
+
+// sessionRegistry 转发中的websocket会话, http.Server.Shutdown 不会等待已升级的连接
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[*wsSession]struct{}
+}
+
+func (r *sessionRegistry) add(client *websocket.Conn) *wsSession {
+	s := &wsSession{client: client}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s] = struct{}{}
+	return s
+}
+
+func (r *sessionRegistry) remove(s *wsSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, s)
+}
+
+func (r *sessionRegistry) snapshot() []*wsSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]*wsSession, 0, len(r.sessions))
+	for s := range r.sessions {
+		list = append(list, s)
+	}
+	return list
+}
+
+// DrainProxy 关闭proxy时通知转发中的websocket客户端, 等待会话结束直到ctx结束, 然后断开剩余会话
+// agent上的任务不受影响, 客户端可以在proxy重启后重新连接查看输出
+func DrainProxy(ctx context.Context) {
+	list := wsSessions.snapshot()
+	if len(list) == 0 {
+		return
+	}
+	msg := "=============== proxy正在关闭, 任务在agent上继续运行 ==============="
+	if deadline, ok := ctx.Deadline(); ok {
+		msg = fmt.Sprintf("=============== proxy正在关闭, %s 后断开连接, 任务在agent上继续运行 ===============", time.Until(deadline).Round(time.Second))
+	}
+	for _, s := range list {
+		_ = s.writeClient(websocket.TextMessage, []byte(msg))
+	}
+	slog.Info("等待websocket会话结束", slog.Int("Sessions", len(list)))
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for len(wsSessions.snapshot()) > 0 {
+		select {
+		case <-ctx.Done():
+			remaining := wsSessions.snapshot()
+			for _, s := range remaining {
+				s.mu.Lock()
+				_ = s.client.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "proxy shutdown"), time.Now().Add(time.Second))
+				s.mu.Unlock()
+				_ = s.client.Close()
+			}
+			slog.Warn("断开未结束的websocket会话", slog.Int("Sessions", len(remaining)))
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ShutdownServer 停止监听并等待处理中的请求结束, ctx结束时强制断开连接
+func ShutdownServer(ctx context.Context, server *http.Server) {
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("等待请求结束超时, 强制断开连接", slog.String("Error", err.Error()))
+		_ = server.Close()
+	}
+}
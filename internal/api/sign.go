@@ -0,0 +1,280 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cmder/internal/audit"
+	"cmder/internal/config"
+)
+
+// proxy转发到agent的请求使用proxy的ed25519私钥或共享密钥(HMAC-SHA256)签名
+// 签名内容: 方法、路径、查询参数、操作用户、时间戳、随机数、请求体的sha256和请求ID
+const (
+	algHMAC    = "CMDER-HMAC-SHA256"
+	algEd25519 = "CMDER-ED25519"
+
+	algorithmHeader = "X-Cmder-Algorithm"
+	keyIdHeader     = "X-Cmder-Key-Id"
+	timestampHeader = "X-Cmder-Timestamp"
+	nonceHeader     = "X-Cmder-Nonce"
+	signatureHeader = "X-Cmder-Signature"
+
+	// maxSignedBody 签名请求体的最大大小, 签名需要读取完整的请求体
+	maxSignedBody = 32 << 20
+)
+
+var (
+	ErrBodyTooLarge = errors.New("请求体过大")
+
+	nonces = &nonceCache{seen: make(map[string]time.Time)}
+
+	signKey = &signKeyCache{}
+)
+
+// signKeyCache 缓存proxy的签名私钥, 配置的文件路径变化时重新读取
+type signKeyCache struct {
+	mu   sync.Mutex
+	path string
+	key  ed25519.PrivateKey
+}
+
+// proxyKey proxy的签名私钥, 未配置时为nil
+func proxyKey() (ed25519.PrivateKey, error) {
+	path := config.GetProxy().PrivateKey
+	if path == "" {
+		return nil, nil
+	}
+	signKey.mu.Lock()
+	defer signKey.mu.Unlock()
+	if signKey.key != nil && signKey.path == path {
+		return signKey.key, nil
+	}
+	key, err := audit.LoadPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	signKey.path, signKey.key = path, key
+	return key, nil
+}
+
+// signHeaders 签名相关的请求头, 不能由客户端透传
+var signHeaders = []string{algorithmHeader, keyIdHeader, timestampHeader, nonceHeader, signatureHeader, "X-Security-Key"}
+
+// stringToSign 构造待签名字符串, 操作用户和请求ID取自请求头
+// 请求ID只在存在时追加为最后一行, 兼容不传递请求ID的旧版proxy; 签名后再添加或修改请求ID都会导致校验失败
+func stringToSign(alg, method string, u *url.URL, h http.Header, timestamp, nonce string, bodyHash string) string {
+	parts := []string{
+		alg,
+		method,
+		u.EscapedPath(),
+		u.Query().Encode(), // 参数按名称排序
+		h.Get(userHeader),
+		timestamp,
+		nonce,
+		bodyHash,
+	}
+	if id := h.Get(requestIdHeader); id != "" {
+		parts = append(parts, id)
+	}
+	return strings.Join(parts, "\n")
+}
+
+func computeSignature(secret, msg string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// KeyId ed25519公钥的标识: sha256的前8字节(hex)
+func KeyId(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// signRequest 为发往agent的请求写入签名头, body 为空表示没有请求体
+// 配置了proxy私钥时使用ed25519签名, 否则使用HMAC
+func signRequest(h http.Header, method string, u *url.URL, body []byte) error {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	priv, err := proxyKey()
+	if err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(buf)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	bodyHash := audit.HashText(string(body))
+
+	var alg, keyId string
+	var sig []byte
+	if priv != nil {
+		alg, keyId = algEd25519, KeyId(priv.Public().(ed25519.PublicKey))
+		sig = ed25519.Sign(priv, []byte(stringToSign(alg, method, u, h, timestamp, nonce, bodyHash)))
+	} else {
+		key := config.GetProxy().GetSignKey()
+		alg, keyId = algHMAC, key.Id
+		sig = computeSignature(key.Secret, stringToSign(alg, method, u, h, timestamp, nonce, bodyHash))
+	}
+	h.Set(algorithmHeader, alg)
+	h.Set(keyIdHeader, keyId)
+	h.Set(timestampHeader, timestamp)
+	h.Set(nonceHeader, nonce)
+	h.Set(signatureHeader, hex.EncodeToString(sig))
+	return nil
+}
+
+// readBody 读取完整请求体用于签名, 超过 maxSignedBody 时返回 ErrBodyTooLarge
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSignedBody {
+		return nil, ErrBodyTooLarge
+	}
+	return body, nil
+}
+
+// verifyRequest 校验请求签名, 通过后记录随机数防止重放
+func verifyRequest(provider config.KeyProvider, r *http.Request, body []byte) error {
+	alg := r.Header.Get(algorithmHeader)
+	keyId := r.Header.Get(keyIdHeader)
+	timestamp := r.Header.Get(timestampHeader)
+	nonce := r.Header.Get(nonceHeader)
+	sig, err := hex.DecodeString(r.Header.Get(signatureHeader))
+	if keyId == "" || timestamp == "" || nonce == "" || err != nil || len(sig) == 0 {
+		return errors.New("缺少签名")
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("无效的时间戳")
+	}
+	skew := provider.GetMaxClockSkew()
+	signedAt := time.Unix(ts, 0)
+	if d := time.Since(signedAt); d > skew || d < -skew {
+		return fmt.Errorf("时间戳超出允许范围: %s", signedAt.Format(time.RFC3339))
+	}
+	msg := stringToSign(alg, r.Method, r.URL, r.Header, timestamp, nonce, audit.HashText(string(body)))
+
+	switch alg {
+	case algEd25519:
+		pub, err := findProxyKey(provider, keyId)
+		if err != nil {
+			return err
+		}
+		if !ed25519.Verify(pub, []byte(msg), sig) {
+			return errors.New("签名错误")
+		}
+	case algHMAC:
+		var secret string
+		for _, k := range provider.GetHMACKeys() {
+			if k.Id == keyId {
+				secret = k.Secret
+				break
+			}
+		}
+		if secret == "" {
+			return fmt.Errorf("未知的签名密钥 %s", keyId)
+		}
+		if !hmac.Equal(sig, computeSignature(secret, msg)) {
+			return errors.New("签名错误")
+		}
+	default:
+		return fmt.Errorf("不支持的签名算法 %s", alg)
+	}
+	// 时间戳超出范围的请求已被拒绝, 随机数只需保留到时间戳过期
+	if !nonces.Add(keyId+":"+nonce, signedAt.Add(skew)) {
+		return errors.New("重复的请求(随机数已使用)")
+	}
+	return nil
+}
+
+// findProxyKey 按标识查找信任的proxy公钥
+func findProxyKey(provider config.KeyProvider, keyId string) (ed25519.PublicKey, error) {
+	for _, k := range provider.GetProxyKeys() {
+		pub, err := k.Decode()
+		if err != nil {
+			return nil, err
+		}
+		if KeyId(pub) == keyId {
+			return pub, nil
+		}
+	}
+	return nil, fmt.Errorf("未信任的proxy公钥 %s", keyId)
+}
+
+// nonceCache 记录已使用的随机数, 过期后清理
+type nonceCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// Add 记录随机数, 已存在时返回false
+func (c *nonceCache) Add(nonce string, expires time.Time) bool {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) > time.Minute {
+		for n, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, n)
+			}
+		}
+		c.lastSweep = now
+	}
+	if exp, ok := c.seen[nonce]; ok && now.Before(exp) {
+		return false
+	}
+	c.seen[nonce] = expires
+	return true
+}
+
+// Key 中间件：校验proxy的请求签名
+// 校验通过后信任proxy传递的操作用户
+func Key(provider config.KeyProvider, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(r)
+		if errors.Is(err, ErrBodyTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "读取请求失败", http.StatusBadRequest)
+			return
+		}
+		if err := verifyRequest(provider, r, body); err != nil {
+			slog.WarnContext(r.Context(), "请求签名校验失败", slog.String("IP", extractIP(r)), slog.String("Path", r.URL.Path), slog.String("Err", err.Error()))
+			auditLog(r, audit.Record{Action: "auth.reject", Status: http.StatusUnauthorized, Error: err.Error()})
+			bans.Fail(r, "签名校验失败")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		if user := r.Header.Get(userHeader); user != "" {
+			r = withUser(r, user)
+		}
+		next(w, r)
+	}
+}
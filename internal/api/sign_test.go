@@ -0,0 +1,176 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"cmder/internal/audit"
+	"cmder/internal/config"
+)
+
+// testKeys 测试用的签名密钥配置
+type testKeys struct {
+	hmac  []config.HMACKey
+	proxy []config.ProxyKey
+}
+
+func (k testKeys) GetHMACKeys() []config.HMACKey   { return k.hmac }
+func (k testKeys) GetProxyKeys() []config.ProxyKey { return k.proxy }
+func (k testKeys) GetMaxClockSkew() time.Duration  { return 5 * time.Minute }
+
+// signer 按proxy的方式为请求签名
+type signer struct {
+	alg    string
+	keyId  string
+	secret string
+	priv   ed25519.PrivateKey
+}
+
+func (s signer) sign(r *http.Request, body []byte, at time.Time, nonce string) {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	msg := stringToSign(s.alg, r.Method, r.URL, r.Header, timestamp, nonce, audit.HashText(string(body)))
+	var sig []byte
+	if s.alg == algEd25519 {
+		sig = ed25519.Sign(s.priv, []byte(msg))
+	} else {
+		sig = computeSignature(s.secret, msg)
+	}
+	r.Header.Set(algorithmHeader, s.alg)
+	r.Header.Set(keyIdHeader, s.keyId)
+	r.Header.Set(timestampHeader, timestamp)
+	r.Header.Set(nonceHeader, nonce)
+	r.Header.Set(signatureHeader, hex.EncodeToString(sig))
+}
+
+func randomNonce(t *testing.T) string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func TestVerifyRequest(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := testKeys{
+		// 轮换期间同时接受新旧密钥
+		hmac:  []config.HMACKey{{Id: "new", Secret: "new-secret"}, {Id: "old", Secret: "old-secret"}},
+		proxy: []config.ProxyKey{{Name: "proxy", PublicKey: base64.StdEncoding.EncodeToString(pub)}},
+	}
+	newKey := signer{alg: algHMAC, keyId: "new", secret: "new-secret"}
+	oldKey := signer{alg: algHMAC, keyId: "old", secret: "old-secret"}
+	edKey := signer{alg: algEd25519, keyId: KeyId(pub), priv: priv}
+
+	const target = "/api/cmd/add?name=web&async=1"
+	body := []byte(`{"command":"uptime"}`)
+
+	tests := []struct {
+		name   string
+		signer signer
+		at     time.Duration // 签名时间相对当前时间的偏移
+		body   []byte        // 签名后实际发送的请求体, 为nil时与签名的相同
+		path   string        // 签名后实际请求的地址, 为空时与签名的相同
+		replay bool          // 使用同一随机数发送两次
+		ok     bool
+	}{
+		{name: "hmac", signer: newKey, ok: true},
+		{name: "ed25519", signer: edKey, ok: true},
+		{name: "rotation old key", signer: oldKey, ok: true},
+		{name: "unknown hmac key", signer: signer{alg: algHMAC, keyId: "gone", secret: "gone"}},
+		{name: "wrong secret", signer: signer{alg: algHMAC, keyId: "new", secret: "old-secret"}},
+		{name: "tampered body", signer: newKey, body: []byte(`{"command":"rm -rf /"}`)},
+		{name: "tampered body ed25519", signer: edKey, body: []byte(`{"command":"rm -rf /"}`)},
+		{name: "tampered path", signer: newKey, path: "/api/cmd/runws?name=web&async=1"},
+		{name: "tampered query", signer: newKey, path: "/api/cmd/add?name=db&async=1"},
+		{name: "within skew", signer: newKey, at: -4 * time.Minute, ok: true},
+		{name: "stale timestamp", signer: newKey, at: -6 * time.Minute},
+		{name: "future timestamp", signer: newKey, at: 6 * time.Minute},
+		{name: "replayed nonce", signer: newKey, replay: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nonce := randomNonce(t)
+			send := func() error {
+				r := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+				r.Header.Set(userHeader, "alice")
+				tt.signer.sign(r, body, time.Now().Add(tt.at), nonce)
+				sent := body
+				if tt.body != nil {
+					sent = tt.body
+				}
+				if tt.path != "" {
+					tampered := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(sent))
+					tampered.Header = r.Header
+					r = tampered
+				}
+				return verifyRequest(keys, r, sent)
+			}
+
+			err := send()
+			if tt.replay {
+				if err != nil {
+					t.Fatalf("first request: %v", err)
+				}
+				err = send()
+			}
+			if tt.ok && err != nil {
+				t.Fatalf("expected valid signature, got %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("expected signature to be rejected")
+			}
+		})
+	}
+}
+
+// 签名覆盖proxy传递的操作用户和请求ID
+func TestVerifyRequestHeaders(t *testing.T) {
+	keys := testKeys{hmac: []config.HMACKey{{Id: "k", Secret: "s"}}}
+	tests := []struct {
+		name   string
+		signed map[string]string // 签名时的请求头
+		sent   map[string]string // 签名后修改的请求头, 空字符串表示删除
+		ok     bool
+	}{
+		{name: "user and request id", signed: map[string]string{userHeader: "bob", requestIdHeader: "req-1"}, ok: true},
+		{name: "without request id", signed: map[string]string{userHeader: "bob"}, ok: true},
+		{name: "tampered user", signed: map[string]string{userHeader: "bob"}, sent: map[string]string{userHeader: "alice"}},
+		{name: "tampered request id", signed: map[string]string{requestIdHeader: "req-1"}, sent: map[string]string{requestIdHeader: "req-2"}},
+		{name: "added request id", signed: map[string]string{userHeader: "bob"}, sent: map[string]string{requestIdHeader: "req-2"}},
+		{name: "removed request id", signed: map[string]string{requestIdHeader: "req-1"}, sent: map[string]string{requestIdHeader: ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/cmd/ids?name=web", nil)
+			for k, v := range tt.signed {
+				r.Header.Set(k, v)
+			}
+			signer{alg: algHMAC, keyId: "k", secret: "s"}.sign(r, nil, time.Now(), randomNonce(t))
+			for k, v := range tt.sent {
+				if v == "" {
+					r.Header.Del(k)
+				} else {
+					r.Header.Set(k, v)
+				}
+			}
+			err := verifyRequest(keys, r, nil)
+			if tt.ok && err != nil {
+				t.Fatalf("expected valid signature, got %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("expected signature to be rejected")
+			}
+		})
+	}
+}
@@ -1,9 +1,19 @@
 package api
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"io"
+	"log/slog"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"sync"
+	"time"
+
+	"cmder/internal/audit"
+	"cmder/internal/config"
 
 	"github.com/gorilla/websocket"
 )
@@ -12,9 +22,17 @@ const maxLogBuffer = 200 // 日志缓存行数
 
 type task struct {
 	Id        string
-	Cmd       *exec.Cmd
-	stdout    io.ReadCloser
-	stderr    io.ReadCloser
+	Cmd       *exec.Cmd // 重启后接管的任务为nil
+	command   string    // 原始命令文本, 用于审计
+	clientIP  string    // 添加任务的来访地址
+	user      string    // 添加任务的用户
+	requestId string    // 添加任务的请求ID
+	target    string    // 启动任务时请求的目标主机名
+	startAt   time.Time // 任务开始运行时间
+	pid       int       // 进程ID, 同时是进程组ID
+	pidStart  uint64    // 进程启动时间(/proc/<pid>/stat), 用于判断pid是否被复用
+	logFile   string    // 输出文件, stdout和stderr都写入该文件
+	lostAt    time.Time // 重启后发现进程已不存在的时间
 	started   bool
 	mu        sync.Mutex
 	clients   map[*websocket.Conn]struct{} // 多个 WS 客户端
@@ -22,23 +40,129 @@ type task struct {
 	logBuffer [][]byte // 最近日志缓存
 }
 
-func newTask(id string, cmd *exec.Cmd) (*task, error) {
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, err
-	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return nil, err
-	}
+func newTask(id, command string, cmd *exec.Cmd) *task {
 	return &task{
 		Id:        id,
 		Cmd:       cmd,
-		stdout:    stdout,
-		stderr:    stderr,
+		command:   command,
 		clients:   make(map[*websocket.Conn]struct{}),
 		logBuffer: make([][]byte, 0, maxLogBuffer),
-	}, nil
+	}
+}
+
+// start 启动任务进程, 输出写入任务目录下的文件, 调用方需持有锁
+// 进程不依赖agent的管道, agent重启后仍可从文件读取输出
+func (t *task) start() error {
+	dir := config.GetAgent().TaskState.Dir
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	logFile, err := filepath.Abs(filepath.Join(dir, t.Id+".log"))
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	t.Cmd.Stdout, t.Cmd.Stderr = f, f
+	err = t.Cmd.Start()
+	// 子进程持有自己的文件描述符
+	_ = f.Close()
+	if err != nil {
+		_ = os.Remove(logFile)
+		return err
+	}
+	t.started = true
+	t.startAt = time.Now()
+	t.pid = t.Cmd.Process.Pid
+	t.pidStart, _, _ = processStart(t.pid)
+	t.logFile = logFile
+	return nil
+}
+
+// watch 等待任务结束: 持续把输出文件的新内容广播给客户端, 进程退出后写审计记录、通知客户端并清理
+// wait 返回退出码(未知时为nil)和错误
+func (t *task) watch(wait func() (*int, error)) {
+	done := make(chan struct{})
+	tailed := make(chan struct{})
+	go func() {
+		defer close(tailed)
+		t.tail(done)
+	}()
+	code, err := wait()
+	close(done)
+	<-tailed
+
+	rec := audit.Record{
+		Action:     "cmd.exit",
+		ClientIP:   t.clientIP,
+		User:       t.user,
+		Target:     t.target,
+		Command:    t.command,
+		TaskId:     t.Id,
+		RequestId:  t.requestId,
+		ExitCode:   code,
+		DurationMs: time.Since(t.startAt).Milliseconds(),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	auditor.Log(rec)
+	observeExit("cmd", time.Since(t.startAt).Seconds(), rec.ExitCode)
+	switch {
+	case errors.Is(err, errExitUnknown):
+		t.closeAll("=============== 命令运行结束(agent重启前启动, 退出码未知) ===============")
+	case err != nil:
+		t.closeAll("=============== 命令运行异常退出 ===============")
+	default:
+		t.closeAll("=============== 命令运行正常退出 ===============")
+	}
+	tasks.Delete(t.Id)
+	_ = os.Remove(t.logFile)
+	tasks.save()
+}
+
+// tail 从头读取输出文件并逐行广播, done关闭(进程退出)后读完剩余内容返回
+func (t *task) tail(done <-chan struct{}) {
+	f, err := os.Open(t.logFile)
+	if err != nil {
+		slog.Error("打开任务输出文件失败", slog.String("TaskId", t.Id), slog.String("Err", err.Error()))
+		<-done
+		return
+	}
+	defer f.Close()
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	reader := bufio.NewReader(f)
+	var partial []byte
+	exited := false
+	for {
+		line, err := reader.ReadBytes('\n')
+		partial = append(partial, line...)
+		if err == nil {
+			t.broadcast(bytes.TrimRight(partial, "\r\n"))
+			partial = nil
+			continue
+		}
+		if err != io.EOF {
+			slog.Error("读取任务输出文件失败", slog.String("TaskId", t.Id), slog.String("Err", err.Error()))
+			<-done
+			return
+		}
+		if exited {
+			if len(partial) > 0 {
+				t.broadcast(partial)
+			}
+			return
+		}
+		// 读到文件末尾, 等待新的输出
+		select {
+		case <-done:
+			exited = true
+		case <-ticker.C:
+		}
+	}
 }
 
 func (t *task) addClient(conn *websocket.Conn) {
@@ -7,13 +7,15 @@ import (
 )
 
 type taskManager struct {
-	mu    sync.Mutex
-	tasks map[string]*task
+	mu     sync.Mutex
+	tasks  map[string]*task
+	lost   map[string]*task // agent重启时进程已不存在的任务, 只能查看输出
+	saveMu sync.Mutex       // 串行化保存任务表
 }
 
 var (
 	ErrTooManyTasks = errors.New("已经达到了运行任务的最大数量")
-	tasks           = &taskManager{tasks: make(map[string]*task)}
+	tasks           = &taskManager{tasks: make(map[string]*task), lost: make(map[string]*task)}
 )
 
 func (m *taskManager) Set(id string, t *task) error {
@@ -30,13 +32,50 @@ func (m *taskManager) Get(id string) (*task, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	t, ok := m.tasks[id]
+	if !ok {
+		t, ok = m.lost[id]
+	}
 	return t, ok
 }
 
+// adopt 接管重启前的任务, 不受任务数量限制
+func (m *taskManager) adopt(t *task) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tasks[t.Id] = t
+}
+
+// markLost 记录丢失的任务
+func (m *taskManager) markLost(t *task) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lost[t.Id] = t
+}
+
+// Lost 丢失的任务ID
+func (m *taskManager) Lost() []string {
+	ids := []string{}
+	for _, t := range m.lostTasks() {
+		ids = append(ids, t.Id)
+	}
+	return ids
+}
+
+func (m *taskManager) lostTasks() []*task {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]*task, 0, len(m.lost))
+	for _, t := range m.lost {
+		list = append(list, t)
+	}
+	return list
+}
+
 func (m *taskManager) Delete(id string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	delete(m.tasks, id)
+	delete(m.lost, id)
 }
 
 func (m *taskManager) All() []string {
@@ -48,3 +87,39 @@ func (m *taskManager) All() []string {
 	}
 	return ids
 }
+
+// snapshot 当前任务列表
+func (m *taskManager) snapshot() []*task {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]*task, 0, len(m.tasks))
+	for _, t := range m.tasks {
+		list = append(list, t)
+	}
+	return list
+}
+
+// Count 已添加未开始和运行中的任务数量
+func (m *taskManager) Count() (queued, running int) {
+	for _, t := range m.snapshot() {
+		t.mu.Lock()
+		if t.started {
+			running++
+		} else {
+			queued++
+		}
+		t.mu.Unlock()
+	}
+	return queued, running
+}
+
+// Clients 每个任务连接的WebSocket客户端数量
+func (m *taskManager) Clients() map[string]int {
+	clients := map[string]int{}
+	for _, t := range m.snapshot() {
+		t.mu.Lock()
+		clients[t.Id] = len(t.clients)
+		t.mu.Unlock()
+	}
+	return clients
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"cmder/internal/audit"
+	"cmder/internal/config"
+)
+
+// taskStateFile 任务表文件名, 位于 taskState.dir 下
+const taskStateFile = "tasks.json"
+
+const (
+	taskRunning = "running"
+	taskLost    = "lost" // agent重启时进程已不存在
+)
+
+// errExitUnknown 接管的任务不是agent的子进程, 无法获取退出码
+var errExitUnknown = errors.New("agent重启前启动的任务, 退出码未知")
+
+// taskRecord 任务表中的一个任务
+type taskRecord struct {
+	Id        string     `json:"id"`
+	Pid       int        `json:"pid"`
+	PidStart  uint64     `json:"pid_start,omitempty"`
+	Start     time.Time  `json:"start"`
+	LogFile   string     `json:"log_file"`
+	Command   string     `json:"command"`
+	User      string     `json:"user,omitempty"`
+	ClientIP  string     `json:"client_ip,omitempty"`
+	RequestId string     `json:"request_id,omitempty"`
+	Target    string     `json:"target,omitempty"`
+	State     string     `json:"state"`
+	LostAt    *time.Time `json:"lost_at,omitempty"`
+}
+
+// save 保存运行中和丢失的任务到任务表, 同时删除超过保留时间的丢失任务; 写入失败只记录日志
+func (m *taskManager) save() {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+	cfg := config.GetAgent().TaskState
+	records := []taskRecord{}
+	for _, t := range m.snapshot() {
+		t.mu.Lock()
+		if t.started {
+			records = append(records, t.record(taskRunning))
+		}
+		t.mu.Unlock()
+	}
+	for _, t := range m.lostTasks() {
+		if ttl := cfg.GetLostTTL(); ttl > 0 && time.Since(t.lostAt) > ttl {
+			m.Delete(t.Id)
+			_ = os.Remove(t.logFile)
+			continue
+		}
+		rec := t.record(taskLost)
+		rec.LostAt = &t.lostAt
+		records = append(records, rec)
+	}
+	if err := writeJSONFile(filepath.Join(cfg.Dir, taskStateFile), records); err != nil {
+		slog.Error("保存任务表失败", slog.String("Err", err.Error()))
+	}
+}
+
+func (t *task) record(state string) taskRecord {
+	return taskRecord{
+		Id:        t.Id,
+		Pid:       t.pid,
+		PidStart:  t.pidStart,
+		Start:     t.startAt,
+		LogFile:   t.logFile,
+		Command:   t.command,
+		User:      t.user,
+		ClientIP:  t.clientIP,
+		RequestId: t.requestId,
+		Target:    t.target,
+		State:     state,
+	}
+}
+
+// RecoverTasks 读取上次保存的任务表并核对进程:
+// 仍在运行的任务重新接管, 从输出文件继续读取输出; 进程已不存在的任务标记为lost, 保留输出供查看
+func RecoverTasks() error {
+	path := filepath.Join(config.GetAgent().TaskState.Dir, taskStateFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取任务表失败: %v", err)
+	}
+	var records []taskRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("解析任务表 %s 失败: %v", path, err)
+	}
+	for _, rec := range records {
+		t := newTask(rec.Id, rec.Command, nil)
+		t.pid, t.pidStart, t.startAt, t.logFile = rec.Pid, rec.PidStart, rec.Start, rec.LogFile
+		t.user, t.clientIP, t.requestId, t.target = rec.User, rec.ClientIP, rec.RequestId, rec.Target
+		t.started = true
+		auditRec := audit.Record{ClientIP: t.clientIP, User: t.user, Target: t.target, Command: t.command, TaskId: t.Id, RequestId: t.requestId,
+			Detail: fmt.Sprintf("pid=%d start=%s", t.pid, t.startAt.Format(time.RFC3339))}
+
+		if rec.State == taskRunning && processAlive(rec.Pid, rec.PidStart) {
+			tasks.adopt(t)
+			go t.watch(waitPid(rec.Pid, rec.PidStart))
+			auditRec.Action = "task.recover"
+			auditor.Log(auditRec)
+			slog.Info("接管重启前的任务", slog.String("TaskId", t.Id), slog.Int("Pid", t.pid))
+			continue
+		}
+
+		if rec.LostAt != nil {
+			t.lostAt = *rec.LostAt
+		} else {
+			t.lostAt = time.Now()
+			auditRec.Action = "task.lost"
+			auditor.Log(auditRec)
+			slog.Warn("任务已丢失, 进程已不存在", slog.String("TaskId", t.Id), slog.Int("Pid", t.pid))
+		}
+		t.loadOutput()
+		t.closeAll("=============== 任务已丢失: agent重启时进程已不存在 ===============")
+		tasks.markLost(t)
+	}
+	tasks.save()
+	return nil
+}
+
+// loadOutput 读取输出文件的最后若干行到日志缓存
+func (t *task) loadOutput() {
+	f, err := os.Open(t.logFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for scanner.Scan() {
+		t.appendLog(scanner.Bytes())
+	}
+}
+
+// waitPid 等待非子进程退出, 只能轮询进程是否存在
+func waitPid(pid int, start uint64) func() (*int, error) {
+	return func() (*int, error) {
+		for processAlive(pid, start) {
+			time.Sleep(time.Second)
+		}
+		return nil, errExitUnknown
+	}
+}
+
+// processStart 读取 /proc/<pid>/stat 中的进程状态和启动时间(系统启动后的时钟周期数)
+func processStart(pid int) (uint64, string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, "", err
+	}
+	// 第2个字段是用括号包围的进程名, 可能包含空格
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, "", fmt.Errorf("无法解析 /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	// 从第3个字段(state)开始, starttime是第22个字段
+	if len(fields) < 20 {
+		return 0, "", fmt.Errorf("无法解析 /proc/%d/stat", pid)
+	}
+	start, err := strconv.ParseUint(fields[19], 10, 64)
+	return start, fields[0], err
+}
+
+// processAlive 进程是否仍在运行, 且启动时间与记录一致(pid没有被其它进程复用)
+// 没有 /proc 时(pidStart为0)只检查pid是否存在
+func processAlive(pid int, pidStart uint64) bool {
+	if pid <= 0 {
+		return false
+	}
+	if pidStart == 0 {
+		return syscall.Kill(pid, 0) == nil
+	}
+	start, state, err := processStart(pid)
+	return err == nil && state != "Z" && start == pidStart
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"cmder/internal/config"
+)
+
+// agentConns 每个target的客户端, 按target名称缓存
+var agentConns sync.Map
+
+// tlsVersion 转换配置中的TLS版本, 默认1.2
+func tlsVersion(v string) uint16 {
+	if v == "1.3" {
+		return tls.VersionTLS13
+	}
+	return tls.VersionTLS12
+}
+
+// loadCertPool 读取PEM格式的CA证书
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取CA证书失败: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s 中没有有效的证书", path)
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig 根据配置生成服务端TLS配置, 未启用TLS时返回nil
+func ServerTLSConfig(cfg config.TLS) (*tls.Config, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("加载证书失败: %v", err)
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tlsVersion(cfg.MinVersion),
+	}
+	if cfg.ClientCA != "" {
+		if conf.ClientCAs, err = loadCertPool(cfg.ClientCA); err != nil {
+			return nil, err
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// ListenAndServe 配置了TLS时使用https, 否则使用http
+func ListenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// agentTLSConfig 连接target的客户端TLS配置: 出示proxy的客户端证书, 用固定的CA校验agent
+func agentTLSConfig(target config.Target) (*tls.Config, error) {
+	cfg := config.GetProxy().AgentTLS
+	conf := &tls.Config{
+		MinVersion: tlsVersion(cfg.MinVersion),
+		ServerName: target.ServerName,
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("加载客户端证书失败: %v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	ca := target.CA
+	if ca == "" {
+		ca = cfg.CA
+	}
+	if ca != "" {
+		pool, err := loadCertPool(ca)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	if len(target.KeyPins) > 0 {
+		// 未配置CA时以固定的公钥作为信任依据, 允许agent使用自签名证书
+		conf.InsecureSkipVerify = ca == ""
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyKeyPin(cs, target.KeyPins)
+		}
+	}
+	return conf, nil
+}
+
+// verifyKeyPin 校验agent证书的公钥是否为固定的公钥之一
+func verifyKeyPin(cs tls.ConnectionState, pins []string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("agent未出示证书")
+	}
+	sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+	if !slices.Contains(pins, pin) {
+		return fmt.Errorf("agent证书公钥 %s 不在固定列表中", pin)
+	}
+	return nil
+}
+
+// agentConn 连接一个target使用的http客户端和TLS配置
+type agentConn struct {
+	client *http.Client
+	tls    *tls.Config // websocket拨号使用, 不能与http.Transport共用(Transport会加入h2协议协商)
+}
+
+// agentConnOf 获取连接target的客户端, 按target名称缓存
+func agentConnOf(target config.Target) (*agentConn, error) {
+	if c, ok := agentConns.Load(target.Name); ok {
+		return c.(*agentConn), nil
+	}
+	conf, err := agentTLSConfig(target)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = conf.Clone()
+	c, _ := agentConns.LoadOrStore(target.Name, &agentConn{client: &http.Client{Transport: transport}, tls: conf})
+	return c.(*agentConn), nil
+}
+
+// agentClient 获取连接target的http客户端
+func agentClient(target config.Target) (*http.Client, error) {
+	c, err := agentConnOf(target)
+	if err != nil {
+		return nil, err
+	}
+	return c.client, nil
+}
+
+// agentDialer 获取连接target的websocket拨号器
+func agentDialer(target config.Target) (*websocket.Dialer, error) {
+	c, err := agentConnOf(target)
+	if err != nil {
+		return nil, err
+	}
+	return &websocket.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  30 * time.Second,
+		EnableCompression: false, // 避免压缩带来的复杂性
+		TLSClientConfig:   c.tls,
+	}, nil
+}
@@ -0,0 +1,342 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"cmder/internal/audit"
+	"cmder/internal/config"
+)
+
+// tokenPrefix API令牌前缀, 令牌格式为 cmdr_<id>_<secret>
+const tokenPrefix = "cmdr_"
+
+var (
+	ErrBadToken = errors.New("无效的API令牌")
+
+	tokens = &tokenStore{}
+)
+
+const tokenCtxKey ctxKey = userCtxKey + 1
+
+// apiToken 一个API令牌, 文件中只保存secret的sha256
+type apiToken struct {
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash,omitempty"`
+	Owner     string     `json:"owner"`   // 创建者
+	Targets   []string   `json:"targets"` // 允许的主机: 主机名 / group:分组名 / *
+	Actions   []string   `json:"actions"` // 允许的操作: view cmd script kill upload / *
+	Created   time.Time  `json:"created"`
+	Expires   time.Time  `json:"expires"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// identity 令牌在审计和agent日志中的身份, 名称可能重复, 附带令牌id区分
+func (t *apiToken) identity() string {
+	return "token:" + t.Name + "#" + t.Id
+}
+
+func (t *apiToken) valid(now time.Time) bool {
+	return t.RevokedAt == nil && now.Before(t.Expires)
+}
+
+// allows 令牌是否允许对target执行action
+func (t *apiToken) allows(target, action string) bool {
+	if !ruleHasTarget(config.Rule{Targets: t.Targets}, target, targetGroups(target)) {
+		return false
+	}
+	if action == config.ActionView && len(t.Actions) > 0 {
+		return true
+	}
+	return slices.Contains(t.Actions, action) || slices.Contains(t.Actions, "*")
+}
+
+// requestToken 获取请求使用的API令牌, 非令牌请求返回nil
+func requestToken(r *http.Request) *apiToken {
+	t, _ := r.Context().Value(tokenCtxKey).(*apiToken)
+	return t
+}
+
+// tokenStore API令牌文件, 变更后整体重写
+type tokenStore struct {
+	mu     sync.Mutex
+	loaded bool
+	tokens []*apiToken
+}
+
+func (s *tokenStore) path() string {
+	return config.GetProxy().GetAuth().TokensFile
+}
+
+// load 首次使用时读取令牌文件, 调用方需持有锁
+func (s *tokenStore) load() error {
+	if s.loaded {
+		return nil
+	}
+	data, err := os.ReadFile(s.path())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("读取令牌文件失败: %v", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.tokens); err != nil {
+			return fmt.Errorf("解析令牌文件失败: %v", err)
+		}
+	}
+	s.loaded = true
+	return nil
+}
+
+// save 先写临时文件再重命名, 调用方需持有锁
+func (s *tokenStore) save() error {
+	return writeJSONFile(s.path(), s.tokens)
+}
+
+// writeJSONFile 先写临时文件再重命名, 避免写入中断时文件损坏
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Create 创建令牌, 返回明文令牌(只在创建时返回一次)
+func (s *tokenStore) Create(t *apiToken) (string, error) {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	// id 使用hex编码, 保证不包含分隔符 _
+	id := hex.EncodeToString(buf)
+	secret, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	t.Id = id
+	t.Hash = hashSecret(secret)
+	t.Created = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return "", err
+	}
+	s.tokens = append(s.tokens, t)
+	if err := s.save(); err != nil {
+		s.tokens = s.tokens[:len(s.tokens)-1]
+		return "", err
+	}
+	return tokenPrefix + id + "_" + secret, nil
+}
+
+// List 列出所有令牌(不含哈希)
+func (s *tokenStore) List() ([]apiToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	list := make([]apiToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		cp := *t
+		cp.Hash = ""
+		list = append(list, cp)
+	}
+	return list, nil
+}
+
+// Revoke 吊销令牌
+func (s *tokenStore) Revoke(id string) (*apiToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	for _, t := range s.tokens {
+		if t.Id != id {
+			continue
+		}
+		if t.RevokedAt == nil {
+			now := time.Now()
+			t.RevokedAt = &now
+			if err := s.save(); err != nil {
+				t.RevokedAt = nil
+				return nil, err
+			}
+		}
+		return t, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// Verify 校验明文令牌, 返回有效的令牌
+func (s *tokenStore) Verify(raw string) (*apiToken, error) {
+	rest, ok := strings.CutPrefix(raw, tokenPrefix)
+	if !ok {
+		return nil, ErrBadToken
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, ErrBadToken
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	for _, t := range s.tokens {
+		if t.Id != id {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashSecret(secret))) != 1 || !t.valid(time.Now()) {
+			return nil, ErrBadToken
+		}
+		cp := *t
+		return &cp, nil
+	}
+	return nil, ErrBadToken
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString 生成n字节随机数的base64url字符串
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// bearerToken 提取 Authorization: Bearer 令牌
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// withToken 将令牌及其身份写入请求上下文
+func withToken(r *http.Request, t *apiToken) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenCtxKey, t)
+	return withUser(r.WithContext(ctx), t.identity())
+}
+
+// ---------------- 令牌管理接口(仅管理员) ----------------
+
+// CreateToken 创建API令牌
+func CreateToken(w http.ResponseWriter, r *http.Request) {
+	if requestToken(r) != nil || !isAdmin(r) {
+		http.Error(w, "没有权限", http.StatusForbidden)
+		return
+	}
+	var req struct {
+		Name      string   `json:"name"`
+		ExpiresIn string   `json:"expires_in"` // 有效期, 如 720h
+		Targets   []string `json:"targets"`
+		Actions   []string `json:"actions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "请求参数错误", http.StatusBadRequest)
+		return
+	}
+	ttl, err := time.ParseDuration(req.ExpiresIn)
+	switch {
+	case req.Name == "":
+		http.Error(w, "令牌名称不能为空", http.StatusBadRequest)
+		return
+	case err != nil || ttl <= 0:
+		http.Error(w, "无效的有效期: "+req.ExpiresIn, http.StatusBadRequest)
+		return
+	case len(req.Targets) == 0 || len(req.Actions) == 0:
+		http.Error(w, "必须指定允许的主机和操作", http.StatusBadRequest)
+		return
+	}
+	for _, a := range req.Actions {
+		if a != "*" && !slices.Contains(allActions, a) {
+			http.Error(w, "无效的操作: "+a, http.StatusBadRequest)
+			return
+		}
+	}
+	t := &apiToken{
+		Name:    req.Name,
+		Owner:   requestUser(r),
+		Targets: req.Targets,
+		Actions: req.Actions,
+		Expires: time.Now().Add(ttl),
+	}
+	raw, err := tokens.Create(t)
+	if err != nil {
+		http.Error(w, "创建令牌失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	auditLog(r, audit.Record{Action: "token.create", Detail: fmt.Sprintf("%s targets=%s actions=%s expires=%s",
+		t.identity(), strings.Join(t.Targets, ","), strings.Join(t.Actions, ","), t.Expires.Format(time.RFC3339))})
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"id":      t.Id,
+		"name":    t.Name,
+		"token":   raw,
+		"expires": t.Expires,
+	})
+}
+
+// ListTokens 列出API令牌
+func ListTokens(w http.ResponseWriter, r *http.Request) {
+	if requestToken(r) != nil || !isAdmin(r) {
+		http.Error(w, "没有权限", http.StatusForbidden)
+		return
+	}
+	list, err := tokens.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"tokens": list})
+}
+
+// RevokeToken 吊销API令牌
+func RevokeToken(w http.ResponseWriter, r *http.Request) {
+	if requestToken(r) != nil || !isAdmin(r) {
+		http.Error(w, "没有权限", http.StatusForbidden)
+		return
+	}
+	t, err := tokens.Revoke(r.PathValue("id"))
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "令牌不存在", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "吊销令牌失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	auditLog(r, audit.Record{Action: "token.revoke", Detail: t.identity()})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,394 @@
+// audit 审计日志: 以 JSON Lines 格式追加记录每一次命令/脚本操作
+// Agent和Proxy各自写自己的审计文件, 文件超过大小后轮转
+// 每条记录包含上一条记录的哈希形成哈希链, 并定期用ed25519私钥签名
+
+package audit
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"cmder/internal/config"
+)
+
+// Record 一条审计记录
+type Record struct {
+	Seq        uint64    `json:"seq"`  // 记录序号, 从1开始连续递增
+	Prev       string    `json:"prev"` // 上一条记录(整行)的sha256
+	Time       time.Time `json:"time"`
+	Source     string    `json:"source"`              // 记录来源: agent/proxy
+	Action     string    `json:"action"`              // 操作类型, 如 cmd.add cmd.exit script.run
+	ClientIP   string    `json:"client_ip,omitempty"` // 来访地址
+	User       string    `json:"user,omitempty"`      // 操作用户
+	Target     string    `json:"target,omitempty"`    // 目标主机
+	Script     string    `json:"script,omitempty"`    // 脚本库中的脚本, 格式为 名称@版本
+	Command    string    `json:"command,omitempty"`   // 命令或脚本文本
+	Hash       string    `json:"hash,omitempty"`      // 命令或脚本的sha256
+	TaskId     string    `json:"task_id,omitempty"`
+	RequestId  string    `json:"request_id,omitempty"` // 请求ID, 关联proxy和agent的日志和记录
+	ExitCode   *int      `json:"exit_code,omitempty"`
+	DurationMs int64     `json:"duration_ms,omitempty"`
+	Status     int       `json:"status,omitempty"` // http状态码
+	Error      string    `json:"error,omitempty"`
+	Detail     string    `json:"detail,omitempty"`        // 其它说明, 如令牌/账号变更的内容
+	Sig        string    `json:"sig,omitempty"`           // audit.sign记录: 对 prev 和 seq 的ed25519签名
+	Purged     uint64    `json:"purged_before,omitempty"` // audit.purge记录: 序号小于该值的记录已随轮转删除
+}
+
+// Filter 审计记录查询条件, 空值表示不过滤
+type Filter struct {
+	From      time.Time
+	To        time.Time
+	Action    string
+	User      string
+	Target    string
+	TaskId    string
+	RequestId string
+	ClientIP  string
+	Limit     int
+}
+
+func (f *Filter) match(rec *Record) bool {
+	switch {
+	case !f.From.IsZero() && rec.Time.Before(f.From):
+		return false
+	case !f.To.IsZero() && rec.Time.After(f.To):
+		return false
+	case f.Action != "" && rec.Action != f.Action:
+		return false
+	case f.User != "" && rec.User != f.User:
+		return false
+	case f.Target != "" && rec.Target != f.Target:
+		return false
+	case f.TaskId != "" && rec.TaskId != f.TaskId:
+		return false
+	case f.RequestId != "" && rec.RequestId != f.RequestId:
+		return false
+	case f.ClientIP != "" && rec.ClientIP != f.ClientIP:
+		return false
+	}
+	return true
+}
+
+// HashText 计算命令或脚本文本的sha256
+func HashText(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// ExitCode 返回退出码指针, 便于填充 Record.ExitCode
+func ExitCode(code int) *int {
+	return &code
+}
+
+// Logger 审计日志写入器, nil Logger 的所有方法均为空操作
+type Logger struct {
+	mu         sync.Mutex
+	source     string
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	seq        uint64             // 最后一条记录的序号
+	prev       string             // 最后一条记录的哈希
+	signer     ed25519.PrivateKey // 为空则不签名
+	signedSeq  uint64             // 最后一次签名时的序号
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// New 打开(或创建)审计日志文件, 并从已有文件恢复哈希链
+func New(cfg config.Audit, source string) (*Logger, error) {
+	path, err := filepath.Abs(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("创建审计目录失败: %v", err)
+	}
+	l := &Logger{
+		source:     source,
+		path:       path,
+		maxSize:    int64(cfg.MaxSize) << 20,
+		maxBackups: cfg.MaxBackups,
+	}
+	if cfg.SignKey != "" {
+		if l.signer, err = LoadPrivateKey(cfg.SignKey); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.recover(); err != nil {
+		return nil, err
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	if l.signer != nil {
+		l.stop = make(chan struct{})
+		l.done = make(chan struct{})
+		go l.signLoop(cfg.SignInterval)
+	}
+	return l, nil
+}
+
+// recover 读取最新审计文件的最后一条记录, 接续序号和哈希链
+func (l *Logger) recover() error {
+	files, err := l.backups()
+	if err != nil {
+		return err
+	}
+	files = append(files, l.path)
+	for i := len(files) - 1; i >= 0; i-- {
+		line, err := lastLine(files[i])
+		if err != nil {
+			return fmt.Errorf("读取审计文件失败: %v", err)
+		}
+		if line == nil {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("审计文件 %s 最后一行无法解析, 请用 verify-audit 校验后处理: %v", files[i], err)
+		}
+		l.seq = rec.Seq
+		l.prev = HashLine(line)
+		if rec.Action == ActionSign {
+			l.signedSeq = rec.Seq
+		}
+		return nil
+	}
+	return nil
+}
+
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("打开审计文件失败: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// Log 追加一条审计记录, 写入失败只记录错误日志不影响业务
+func (l *Logger) Log(rec Record) {
+	if l == nil {
+		return
+	}
+	if rec.Command != "" && rec.Hash == "" {
+		rec.Hash = HashText(rec.Command)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size >= l.maxSize {
+		if err := l.rotate(); err != nil {
+			slog.Error("审计文件轮转失败", slog.String("Err", err.Error()))
+		}
+	}
+	l.append(rec)
+}
+
+// append 填充序号和哈希链后写入一条记录, 调用方需持有锁
+func (l *Logger) append(rec Record) {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	rec.Source = l.source
+	rec.Seq = l.seq + 1
+	rec.Prev = l.prev
+	if rec.Action == ActionSign {
+		rec.Sig = sign(l.signer, rec.Seq, rec.Prev)
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("审计记录序列化失败", slog.String("Err", err.Error()))
+		return
+	}
+	n, err := l.file.Write(append(line, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		// 写入失败时不推进哈希链, 残缺的行会在校验时报告
+		slog.Error("写入审计记录失败", slog.String("Err", err.Error()))
+		return
+	}
+	l.seq = rec.Seq
+	l.prev = HashLine(line)
+	if rec.Action == ActionSign {
+		l.signedSeq = rec.Seq
+		// 同时输出到运行日志, 作为文件之外的锚点用于发现尾部截断
+		slog.Info("审计签名", slog.Uint64("Seq", rec.Seq), slog.String("Prev", rec.Prev))
+	}
+}
+
+// rotate 将当前文件重命名为带时间戳的备份, 并清理多余的备份
+// 哈希链跨文件延续, 删除备份时写入 audit.purge 记录说明被删除的序号范围
+func (l *Logger) rotate() error {
+	// 轮转前签名, 保证每个备份文件都以签名结尾
+	if l.signer != nil && l.signedSeq < l.seq {
+		l.append(Record{Action: ActionSign})
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	backup := l.path + "." + time.Now().Format("20060102T150405.000000")
+	if err := os.Rename(l.path, backup); err != nil {
+		return err
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	backups, err := l.backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > l.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+		if before, err := firstSeq(backups[0]); err == nil && before > 0 {
+			l.append(Record{Action: ActionPurge, Purged: before})
+		}
+	}
+	return nil
+}
+
+// signLoop 定期对新增的记录签名
+func (l *Logger) signLoop(interval time.Duration) {
+	defer close(l.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.Sign()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// Sign 如有未签名的记录则立即写入一条签名记录
+func (l *Logger) Sign() {
+	if l == nil || l.signer == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.signedSeq < l.seq {
+		l.append(Record{Action: ActionSign})
+	}
+}
+
+// backups 按时间升序返回轮转后的备份文件
+func (l *Logger) backups() ([]string, error) {
+	return backups(l.path)
+}
+
+func backups(path string) ([]string, error) {
+	files, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// FilesOf 按时间升序返回审计文件 path 的所有备份及其本身
+func FilesOf(path string) ([]string, error) {
+	files, err := backups(path)
+	if err != nil {
+		return nil, err
+	}
+	return append(files, path), nil
+}
+
+// Files 按时间升序返回所有审计文件(备份在前, 当前文件在最后)
+func (l *Logger) Files() ([]string, error) {
+	if l == nil {
+		return nil, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return FilesOf(l.path)
+}
+
+// Query 按条件查询审计记录, 按时间倒序返回
+func (l *Logger) Query(f Filter) ([]Record, error) {
+	files, err := l.Files()
+	if err != nil {
+		return nil, err
+	}
+	if f.Limit <= 0 {
+		f.Limit = 100
+	}
+	var records []Record
+	// 从最新的文件开始读取, 取够Limit条即停止
+	for i := len(files) - 1; i >= 0 && len(records) < f.Limit; i-- {
+		matched, err := readFile(files[i], &f)
+		if err != nil {
+			return nil, err
+		}
+		for j := len(matched) - 1; j >= 0 && len(records) < f.Limit; j-- {
+			records = append(records, matched[j])
+		}
+	}
+	return records, nil
+}
+
+// readFile 读取单个审计文件中满足条件的记录
+func readFile(path string, f *Filter) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if f.match(&rec) {
+			records = append(records, rec)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// Close 签名剩余记录并关闭审计文件
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+	}
+	l.Sign()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
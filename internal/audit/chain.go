@@ -0,0 +1,275 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	ActionSign  = "audit.sign"  // 签名记录
+	ActionPurge = "audit.purge" // 轮转删除旧文件的记录
+)
+
+// HashLine 计算一行审计记录(不含换行符)的sha256, 作为下一条记录的 prev
+func HashLine(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// signMessage 签名内容: 序号和上一条记录的哈希(哈希链覆盖了之前的所有记录)
+func signMessage(seq uint64, prev string) []byte {
+	return []byte(fmt.Sprintf("cmder-audit:%d:%s", seq, prev))
+}
+
+func sign(key ed25519.PrivateKey, seq uint64, prev string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, signMessage(seq, prev)))
+}
+
+func verifySig(pub ed25519.PublicKey, seq uint64, prev, sig string) bool {
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pub, signMessage(seq, prev), raw)
+}
+
+// LoadPrivateKey 读取PEM格式(PKCS8)的ed25519私钥
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("解析私钥 %s 失败: %v", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s 不是ed25519私钥", path)
+	}
+	return priv, nil
+}
+
+// LoadPublicKey 读取PEM格式的ed25519公钥, 也可以直接传入私钥文件
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "PRIVATE KEY" {
+		priv, err := LoadPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+		return priv.Public().(ed25519.PublicKey), nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("解析公钥 %s 失败: %v", path, err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s 不是ed25519公钥", path)
+	}
+	return pub, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取密钥文件失败: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s 不是PEM格式", path)
+	}
+	return block, nil
+}
+
+// lastLine 读取文件最后一个非空行, 文件不存在或为空时返回nil
+func lastLine(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// 从文件末尾向前按块读取, 直到找到倒数第二个换行符
+	const chunk = 64 * 1024
+	var buf []byte
+	for off := info.Size(); off > 0; {
+		n := int64(chunk)
+		if off < n {
+			n = off
+		}
+		off -= n
+		part := make([]byte, n)
+		if _, err := f.ReadAt(part, off); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		buf = append(part, buf...)
+		trimmed := bytes.TrimRight(buf, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+		if off == 0 && len(trimmed) > 0 {
+			return trimmed, nil
+		}
+	}
+	return nil, nil
+}
+
+// firstSeq 读取文件第一条记录的序号
+func firstSeq(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	var rec Record
+	if err := json.Unmarshal(bytes.TrimRight(line, "\n"), &rec); err != nil {
+		return 0, err
+	}
+	return rec.Seq, nil
+}
+
+// Report 审计文件校验结果
+type Report struct {
+	Files      int      `json:"files"`
+	Records    int      `json:"records"`
+	FirstSeq   uint64   `json:"first_seq"`
+	LastSeq    uint64   `json:"last_seq"`
+	SignedSeq  uint64   `json:"signed_seq"` // 最后一条有效签名的序号
+	Signatures int      `json:"signatures"`
+	Problems   []string `json:"problems"` // 发现的篡改/截断/删除
+	Warnings   []string `json:"warnings"` // 无法确认的部分
+}
+
+// OK 是否未发现问题
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *Report) problem(format string, args ...any) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+func (r *Report) warn(format string, args ...any) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Verify 按时间顺序校验审计文件的哈希链和签名
+// pub 为空时只校验哈希链, 不校验签名
+func Verify(files []string, pub ed25519.PublicKey) (*Report, error) {
+	r := &Report{}
+	var (
+		prev   string
+		purged = map[uint64]bool{}
+	)
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		r.Files++
+		reader := bufio.NewReader(f)
+		for lineNo := 1; ; lineNo++ {
+			line, err := reader.ReadBytes('\n')
+			if len(line) == 0 && errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil && !errors.Is(err, io.EOF) {
+				_ = f.Close()
+				return nil, err
+			}
+			if line[len(line)-1] != '\n' {
+				r.problem("%s:%d 记录不完整(文件被截断)", path, lineNo)
+			}
+			line = bytes.TrimRight(line, "\n")
+			var rec Record
+			if err := json.Unmarshal(line, &rec); err != nil {
+				r.problem("%s:%d 记录无法解析: %v", path, lineNo, err)
+				// 按一条记录计数, 避免后续记录被误报为序号不连续
+				r.Records++
+				r.LastSeq++
+				prev = HashLine(line)
+				continue
+			}
+			switch {
+			case r.Records == 0:
+				r.FirstSeq = rec.Seq
+				if rec.Seq == 1 && rec.Prev != "" {
+					r.problem("%s:%d 第一条记录的prev不为空", path, lineNo)
+				}
+			case rec.Seq != r.LastSeq+1:
+				r.problem("%s:%d 序号不连续: 期望 %d, 实际 %d (记录被删除或插入)", path, lineNo, r.LastSeq+1, rec.Seq)
+			case rec.Prev != prev:
+				r.problem("%s:%d 哈希链断裂: 序号 %d 之前的记录被修改", path, lineNo, rec.Seq)
+			}
+			switch rec.Action {
+			case ActionSign:
+				r.Signatures++
+				switch {
+				case pub == nil:
+				case verifySig(pub, rec.Seq, rec.Prev, rec.Sig):
+					r.SignedSeq = rec.Seq
+				default:
+					r.problem("%s:%d 序号 %d 的签名无效", path, lineNo, rec.Seq)
+				}
+			case ActionPurge:
+				purged[rec.Purged] = true
+			}
+			r.Records++
+			r.LastSeq = rec.Seq
+			prev = HashLine(line)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+		}
+		_ = f.Close()
+	}
+
+	if r.Records == 0 {
+		r.warn("没有审计记录")
+		return r, nil
+	}
+	if r.FirstSeq != 1 && !purged[r.FirstSeq] {
+		r.problem("审计记录从序号 %d 开始, 但没有对应的 %s 记录 (开头的记录或文件被删除)", r.FirstSeq, ActionPurge)
+	}
+	switch {
+	case pub == nil:
+		r.warn("未提供公钥, 跳过签名校验")
+	case r.Signatures == 0:
+		r.warn("没有签名记录, 无法发现尾部截断")
+	case r.SignedSeq < r.LastSeq:
+		r.warn("序号 %d 之后的 %d 条记录尚未签名, 无法确认其完整性", r.SignedSeq, r.LastSeq-r.SignedSeq)
+	}
+	if pub != nil && r.SignedSeq > 0 {
+		r.warn("最后签名序号为 %d, 请与运行日志中的\"审计签名\"比对以发现尾部截断", r.SignedSeq)
+	}
+	return r, nil
+}
@@ -0,0 +1,244 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cmder/internal/config"
+)
+
+// writeKey 生成ed25519私钥并写入PEM文件
+func writeKey(t *testing.T, dir string) (string, ed25519.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "audit.key")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, pub
+}
+
+// writeChain 写入审计记录: 3条命令、签名、2条命令、关闭时签名, 共7条
+func writeChain(t *testing.T) (string, ed25519.PublicKey) {
+	t.Helper()
+	dir := t.TempDir()
+	key, pub := writeKey(t, dir)
+	path := filepath.Join(dir, "audit.jsonl")
+	l, err := New(config.Audit{File: path, MaxSize: 100, MaxBackups: 10, SignKey: key, SignInterval: time.Hour}, "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{"uptime", "df -h", "free -m"} {
+		l.Log(Record{Action: "cmd.add", User: "alice", Command: cmd})
+	}
+	l.Sign()
+	for _, cmd := range []string{"ls /tmp", "whoami"} {
+		l.Log(Record{Action: "cmd.add", User: "bob", Command: cmd})
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path, pub
+}
+
+func readLines(t *testing.T, path string) [][]byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+}
+
+func writeLines(t *testing.T, path string, lines [][]byte) {
+	t.Helper()
+	data := append(bytes.Join(lines, []byte("\n")), '\n')
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// editRecord 修改第i行记录后重新序列化
+func editRecord(t *testing.T, lines [][]byte, i int, edit func(*Record)) {
+	t.Helper()
+	var rec Record
+	if err := json.Unmarshal(lines[i], &rec); err != nil {
+		t.Fatal(err)
+	}
+	edit(&rec)
+	line, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines[i] = line
+}
+
+func hasProblem(r *Report, substr string) bool {
+	for _, p := range r.Problems {
+		if strings.Contains(p, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestVerifyIntact(t *testing.T) {
+	path, pub := writeChain(t)
+	r, err := Verify([]string{path}, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() {
+		t.Fatalf("unexpected problems: %v", r.Problems)
+	}
+	if r.Records != 7 || r.FirstSeq != 1 || r.LastSeq != 7 || r.Signatures != 2 || r.SignedSeq != 7 {
+		t.Fatalf("unexpected report: %+v", r)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		tamper  func(t *testing.T, path string)
+		wrong   bool   // 使用其它公钥校验
+		problem string // 期望报告的问题
+	}{
+		{
+			name: "edited record",
+			tamper: func(t *testing.T, path string) {
+				lines := readLines(t, path)
+				editRecord(t, lines, 1, func(rec *Record) { rec.Command, rec.Hash = "rm -rf /", HashText("rm -rf /") })
+				writeLines(t, path, lines)
+			},
+			problem: "哈希链断裂",
+		},
+		{
+			// 同时修改后一条记录的prev也无法通过签名校验
+			name: "edited record with rebuilt chain",
+			tamper: func(t *testing.T, path string) {
+				lines := readLines(t, path)
+				editRecord(t, lines, 1, func(rec *Record) { rec.User = "mallory" })
+				for i := 2; i < len(lines); i++ {
+					prev := HashLine(lines[i-1])
+					editRecord(t, lines, i, func(rec *Record) { rec.Prev = prev })
+				}
+				writeLines(t, path, lines)
+			},
+			problem: "签名无效",
+		},
+		{
+			name: "deleted record",
+			tamper: func(t *testing.T, path string) {
+				lines := readLines(t, path)
+				writeLines(t, path, append(lines[:2:2], lines[3:]...))
+			},
+			problem: "序号不连续",
+		},
+		{
+			name: "deleted first record",
+			tamper: func(t *testing.T, path string) {
+				writeLines(t, path, readLines(t, path)[1:])
+			},
+			problem: "没有对应的",
+		},
+		{
+			name: "truncated tail",
+			tamper: func(t *testing.T, path string) {
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Truncate(path, info.Size()-10); err != nil {
+					t.Fatal(err)
+				}
+			},
+			problem: "文件被截断",
+		},
+		{
+			name: "bad signature",
+			tamper: func(t *testing.T, path string) {
+				lines := readLines(t, path)
+				last := len(lines) - 1
+				editRecord(t, lines, last, func(rec *Record) {
+					sig, _ := base64.StdEncoding.DecodeString(rec.Sig)
+					sig[0] ^= 0xff
+					rec.Sig = base64.StdEncoding.EncodeToString(sig)
+				})
+				writeLines(t, path, lines)
+			},
+			problem: "签名无效",
+		},
+		{
+			name:    "wrong public key",
+			tamper:  func(t *testing.T, path string) {},
+			wrong:   true,
+			problem: "签名无效",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, pub := writeChain(t)
+			tt.tamper(t, path)
+			if tt.wrong {
+				pub = otherPub
+			}
+			r, err := Verify([]string{path}, pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.OK() {
+				t.Fatal("tampering not detected")
+			}
+			if !hasProblem(r, tt.problem) {
+				t.Fatalf("expected problem %q, got %v", tt.problem, r.Problems)
+			}
+		})
+	}
+}
+
+// 删除尾部的完整记录(包括最后的签名)后哈希链仍然连续, 只能通过最后签名序号发现
+func TestVerifyDroppedTail(t *testing.T) {
+	path, pub := writeChain(t)
+	lines := readLines(t, path)
+	writeLines(t, path, lines[:len(lines)-3])
+
+	r, err := Verify([]string{path}, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() {
+		t.Fatalf("unexpected problems: %v", r.Problems)
+	}
+	if r.SignedSeq != 4 || r.LastSeq != 4 {
+		t.Fatalf("expected chain to end at signed seq 4, got %+v", r)
+	}
+	var found bool
+	for _, w := range r.Warnings {
+		found = found || strings.Contains(w, "最后签名序号为 4")
+	}
+	if !found {
+		t.Fatalf("expected last signed seq warning, got %v", r.Warnings)
+	}
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access 控制台允许访问的时间
+// 未配置windows时使用 accessStartTime ~ accessEndTime 作为每天的时间段
+type Access struct {
+	TimeZone  string         `yaml:"timeZone"`  // IANA时区, 如 Asia/Shanghai, 为空使用本机时区
+	Windows   []AccessWindow `yaml:"windows"`   // 允许访问的时间段, 满足任意一个即可访问
+	Blackouts []string       `yaml:"blackouts"` // 全天禁止访问的日期(节假日): 2026-10-01 或 2026-10-01~2026-10-07
+}
+
+// AccessWindow 一个允许访问的时间段
+// End 小于等于 Start 时表示跨夜, 持续到次日的 End
+type AccessWindow struct {
+	Days  []string      `yaml:"days"`  // mon tue wed thu fri sat sun / weekdays / weekend, 为空表示每天
+	Start time.Duration `yaml:"start"` // 开始时间, 如 9h
+	End   time.Duration `yaml:"end"`   // 结束时间, 如 18h30m; 24h 表示当天结束
+}
+
+// DateRange 一段日期 [From, To], 按所在时区的日期比较
+type DateRange struct {
+	From, To time.Time
+}
+
+var weekdays = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekend":  {time.Saturday, time.Sunday},
+}
+
+// locations 已加载的时区, LoadLocation 每次都会读取时区文件
+var locations sync.Map
+
+// Location 访问时间使用的时区
+func (a Access) Location() *time.Location {
+	if a.TimeZone == "" {
+		return time.Local
+	}
+	if loc, ok := locations.Load(a.TimeZone); ok {
+		return loc.(*time.Location)
+	}
+	loc, err := time.LoadLocation(a.TimeZone)
+	if err != nil {
+		// 已在加载配置时校验
+		return time.Local
+	}
+	locations.Store(a.TimeZone, loc)
+	return loc
+}
+
+// Weekdays 时间段生效的星期, 为空表示每天
+func (w AccessWindow) Weekdays() []time.Weekday {
+	var days []time.Weekday
+	for _, d := range w.Days {
+		days = append(days, weekdays[strings.ToLower(d)]...)
+	}
+	return days
+}
+
+// BlackoutRanges 解析禁止访问的日期
+func (a Access) BlackoutRanges() ([]DateRange, error) {
+	ranges := make([]DateRange, 0, len(a.Blackouts))
+	for _, b := range a.Blackouts {
+		r, err := parseDateRange(b)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// parseDateRange 解析日期 2026-10-01 或日期范围 2026-10-01~2026-10-07
+func parseDateRange(b string) (DateRange, error) {
+	from, to, isRange := strings.Cut(b, "~")
+	start, err := time.Parse(time.DateOnly, strings.TrimSpace(from))
+	if err != nil {
+		return DateRange{}, fmt.Errorf("无效的日期 %s", b)
+	}
+	end := start
+	if isRange {
+		if end, err = time.Parse(time.DateOnly, strings.TrimSpace(to)); err != nil || end.Before(start) {
+			return DateRange{}, fmt.Errorf("无效的日期范围 %s", b)
+		}
+	}
+	return DateRange{From: start, To: end}, nil
+}
+
+// validate 校验时区、时间段和禁止访问的日期
+func (a Access) validate(errs *errorList, path string) {
+	if a.TimeZone != "" {
+		if _, err := time.LoadLocation(a.TimeZone); err != nil {
+			errs.add(join(path, "timeZone"), "无效的时区 %s", a.TimeZone)
+		}
+	}
+	for i, w := range a.Windows {
+		wp := index(join(path, "windows"), i)
+		for _, d := range w.Days {
+			if _, ok := weekdays[strings.ToLower(d)]; !ok {
+				errs.add(join(wp, "days"), "无效的星期 %s", d)
+			}
+		}
+		if w.Start < 0 || w.Start >= 24*time.Hour {
+			errs.add(join(wp, "start"), "需在 0~24h 之间: %s", w.Start)
+		}
+		if w.End < 0 || w.End > 24*time.Hour {
+			errs.add(join(wp, "end"), "需在 0~24h 之间: %s", w.End)
+		}
+	}
+	for i, b := range a.Blackouts {
+		if _, err := parseDateRange(b); err != nil {
+			errs.add(index(join(path, "blackouts"), i), "%v", err)
+		}
+	}
+}
@@ -1,47 +1,156 @@
 package config
 
 import (
-	"errors"
+	"strings"
 	"time"
 )
 
 var (
-	// 预留命令行参数
+	// 配置文件路径, 由命令行参数 -config 设置
 	AgentFile string
 	agent     *Loader[Agent]
 )
 
 type Agent struct {
-	Addr          string        `yaml:"addr" default:"localhost:5544"`
-	TaskNum       int           `yaml:"taskNum" default:"8"`
-	ReadTimeout   time.Duration `yaml:"readTimeout" default:"60m"`
-	WriteTimeout  time.Duration `yaml:"writeTimeout" default:"60m"`
-	XSecurityKey  string        `yaml:"xSecurityKey" default:"xSecurityKey"`
-	WhiteList     []string      `yaml:"whiteList"`
-	ForbiddenCmds []string      `yaml:"forbiddenCmds"`
+	Addr           string        `yaml:"addr" default:"localhost:5544"`
+	TaskNum        int           `yaml:"taskNum" default:"8"`
+	ReadTimeout    time.Duration `yaml:"readTimeout" default:"60m"`
+	WriteTimeout   time.Duration `yaml:"writeTimeout" default:"60m"`
+	DrainTimeout   time.Duration `yaml:"drainTimeout" default:"30s"` // 关闭时等待运行中任务结束的最长时间, 超时后终止任务
+	TaskState      TaskState     `yaml:"taskState"`                  // 任务表和输出文件, 重启后据此恢复任务
+	XSecurityKey   string        `yaml:"xSecurityKey"`               // 已废弃, 未配置hmacKeys时作为签名密钥
+	HMACKeys       []HMACKey     `yaml:"hmacKeys"`                   // 接受的请求签名密钥, 轮换时可同时配置多个
+	ProxyKeys      []ProxyKey    `yaml:"proxyKeys"`                  // 信任的proxy公钥, 配置后不再接受 xSecurityKey
+	MaxClockSkew   time.Duration `yaml:"maxClockSkew" default:"5m"`  // 签名时间戳允许的最大偏差
+	WhiteList      []string      `yaml:"whiteList"`
+	TrustedProxies []string      `yaml:"trustedProxies"` // 可信的反向代理(IP或CIDR), 只信任它们传递的客户端地址
+	BlackList      []string      `yaml:"blackList"`      // IP黑名单(IP或CIDR), 优先于白名单
+	Ban            Ban           `yaml:"ban"`            // 认证失败自动封禁
+	RateLimits     []RateLimit   `yaml:"rateLimits"`     // 限流规则
+	ForbiddenCmds  []string      `yaml:"forbiddenCmds"`
+	Audit          Audit         `yaml:"audit"`
+	Log            Log           `yaml:"log"` // 运行日志
+	TLS            TLS           `yaml:"tls"` // 配置证书后使用https, 配置clientCA后要求proxy出示客户端证书
+}
+
+// TaskState 任务状态持久化: 任务输出写入文件, 任务表(ID、PID、开始时间、输出文件)保存到 dir/tasks.json
+type TaskState struct {
+	Dir        string         `yaml:"dir" default:"./tasks"` // 任务表和输出文件目录
+	LostTTL    *time.Duration `yaml:"lostTTL" default:"24h"` // 重启后进程已不存在的任务(lost)保留多久, 之后删除记录和输出文件, 0 表示不删除
+	KeepOnExit bool           `yaml:"keepOnExit"`            // 关闭agent时不终止运行中的任务, 重启后重新接管(用于升级)
+}
+
+// GetLostTTL 丢失任务的保留时长, 0 表示不删除
+func (s TaskState) GetLostTTL() time.Duration {
+	if s.LostTTL == nil {
+		return 0
+	}
+	return *s.LostTTL
 }
 
 func (a *Agent) Validate() error {
-	if a.Addr == "" {
-		return errors.New("监听地址不能为空")
+	var errs errorList
+	validateAddr(&errs, "addr", a.Addr)
+	if a.TaskNum <= 0 {
+		errs.add("taskNum", "必须大于0")
 	}
+	validateNonNegative(&errs, "readTimeout", a.ReadTimeout)
+	validateNonNegative(&errs, "writeTimeout", a.WriteTimeout)
+	validateNonNegative(&errs, "drainTimeout", a.DrainTimeout)
+	if a.TaskState.Dir == "" {
+		errs.add("taskState.dir", "不能为空")
+	}
+	validateNonNegative(&errs, "taskState.lostTTL", a.TaskState.GetLostTTL())
+	validateNonNegative(&errs, "maxClockSkew", a.MaxClockSkew)
 	if len(a.WhiteList) == 0 {
-		return errors.New("主机白名单不能为空")
+		errs.add("whiteList", "主机白名单不能为空")
+	}
+	validateNets(&errs, "whiteList", a.WhiteList)
+	validateNets(&errs, "trustedProxies", a.TrustedProxies)
+	validateNets(&errs, "blackList", a.BlackList)
+	for i, cmd := range a.ForbiddenCmds {
+		if strings.TrimSpace(cmd) == "" {
+			errs.add(index("forbiddenCmds", i), "不能为空, 空字符串会禁止所有命令")
+		}
 	}
-	return nil
+	a.Ban.validate(&errs, "ban")
+	validateRateLimits(&errs, a.RateLimits)
+	a.TLS.validate(&errs, "tls")
+	a.Audit.validate(&errs, "audit")
+	a.Log.validate(&errs, "log")
+	validateProxyKeys(&errs, a.ProxyKeys)
+	// 只配置了proxy公钥时不需要对称密钥
+	if len(a.ProxyKeys) == 0 || len(a.HMACKeys) > 0 {
+		validateHMACKeys(&errs, a.HMACKeys, a.XSecurityKey)
+	}
+	return errs.err()
 }
 
 func (a *Agent) GetWhiteList() []string {
 	return a.WhiteList
 }
 
+func (a *Agent) GetTrustedProxies() []string {
+	return a.TrustedProxies
+}
+
+func (a *Agent) GetBlackList() []string {
+	return a.BlackList
+}
+
+func (a *Agent) GetBan() Ban {
+	return a.Ban
+}
+
+// GetBanExempt 可信反向代理转发了所有proxy的请求, 不自动封禁;
+// 白名单中的proxy签名校验失败仍然计数并封禁
+func (a *Agent) GetBanExempt() []string {
+	return a.TrustedProxies
+}
+
+func (a *Agent) GetRateLimits() []RateLimit {
+	return a.RateLimits
+}
+
 func (a *Agent) GetXSecurityKey() string {
 	return a.XSecurityKey
 }
 
+// GetHMACKeys 接受的对称签名密钥, 配置了proxy公钥时不使用 xSecurityKey
+func (a *Agent) GetHMACKeys() []HMACKey {
+	if len(a.ProxyKeys) > 0 {
+		return a.HMACKeys
+	}
+	return hmacKeys(a.HMACKeys, a.XSecurityKey)
+}
+
+func (a *Agent) GetProxyKeys() []ProxyKey {
+	return a.ProxyKeys
+}
+
+func (a *Agent) GetMaxClockSkew() time.Duration {
+	return a.MaxClockSkew
+}
+
+func (a *Agent) GetLog() Log {
+	return a.Log
+}
+
+func (a *Agent) GetAudit() Audit {
+	return a.Audit
+}
+
 func GetAgent() *Agent {
 	if AgentFile == "" {
 		AgentFile = "./config.yaml"
 	}
-	return getConfig(&agent, AgentFile)
+	return getConfig(&agent, AgentFile, "CMDER_AGENT")
+}
+
+// LoadAgent 加载配置, 与 GetAgent 相同但失败时返回错误
+func LoadAgent() (*Agent, error) {
+	if AgentFile == "" {
+		AgentFile = "./config.yaml"
+	}
+	return loadConfig(&agent, AgentFile, "CMDER_AGENT")
 }
@@ -0,0 +1,22 @@
+package config
+
+import "time"
+
+// Audit 审计日志配置, Agent和Proxy共用
+type Audit struct {
+	File         string        `yaml:"file" default:"./audit.jsonl"` // 审计日志文件(JSON Lines)
+	MaxSize      int           `yaml:"maxSize" default:"100"`        // 单个文件最大大小(MB), 超过后轮转
+	MaxBackups   int           `yaml:"maxBackups" default:"10"`      // 保留的轮转文件数量
+	SignKey      string        `yaml:"signKey"`                      // ed25519私钥文件(PEM), 为空则不签名
+	SignInterval time.Duration `yaml:"signInterval" default:"1m"`    // 签名间隔
+}
+
+func (a Audit) validate(errs *errorList, path string) {
+	if a.MaxSize < 0 {
+		errs.add(join(path, "maxSize"), "不能为负数")
+	}
+	if a.MaxBackups < 0 {
+		errs.add(join(path, "maxBackups"), "不能为负数")
+	}
+	validateNonNegative(errs, join(path, "signInterval"), a.SignInterval)
+}
@@ -0,0 +1,25 @@
+package config
+
+import "time"
+
+// Ban 自动封禁配置, Agent和Proxy共用
+// 窗口内失败次数达到MaxFailures后封禁该IP, 再次被封禁时封禁时长翻倍, 最长MaxBanTime
+type Ban struct {
+	Disabled    bool          `yaml:"disabled"`                 // 关闭自动封禁(blackList仍然生效)
+	MaxFailures int           `yaml:"maxFailures" default:"5"`  // 窗口内允许的失败次数
+	Window      time.Duration `yaml:"window" default:"10m"`     // 统计失败次数的滑动窗口
+	BanTime     time.Duration `yaml:"banTime" default:"15m"`    // 第一次封禁时长
+	MaxBanTime  time.Duration `yaml:"maxBanTime" default:"24h"` // 最长封禁时长, 超过该时间未再被封禁则重新计算
+}
+
+func (b Ban) validate(errs *errorList, path string) {
+	if b.MaxFailures < 0 {
+		errs.add(join(path, "maxFailures"), "不能为负数")
+	}
+	validateNonNegative(errs, join(path, "window"), b.Window)
+	validateNonNegative(errs, join(path, "banTime"), b.BanTime)
+	validateNonNegative(errs, join(path, "maxBanTime"), b.MaxBanTime)
+	if b.BanTime > 0 && b.MaxBanTime > 0 && b.BanTime > b.MaxBanTime {
+		errs.add(join(path, "banTime"), "不能大于 maxBanTime")
+	}
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"maps"
+	"regexp"
+	"slices"
+)
+
+// ChangeWindow 变更窗口: 匹配的主机上受限的操作只能在窗口时间内执行
+//
+// 命令类别在 commandClasses 中定义, classes 为空时限制所有命令,
+// 命令的每一行都属于 except 中的类别(如只读命令)时不受限制
+type ChangeWindow struct {
+	Name    string           `yaml:"name"`
+	Targets []string         `yaml:"targets"` // 主机名 / group:分组名 / *, 为空表示所有主机
+	Actions []string         `yaml:"actions"` // 受限的操作: cmd script kill upload, 为空表示全部(view不受限)
+	Classes []string         `yaml:"classes"` // 只限制属于这些类别的命令
+	Except  []string         `yaml:"except"`  // 不受限制的命令类别
+	Access  `yaml:",inline"` // 窗口时间: timeZone / windows / blackouts
+}
+
+// validateChangeWindows 校验变更窗口和命令类别
+func validateChangeWindows(errs *errorList, windows []ChangeWindow, classes map[string][]string) {
+	for _, name := range slices.Sorted(maps.Keys(classes)) {
+		for i, p := range classes[name] {
+			if _, err := regexp.Compile(p); err != nil {
+				errs.add(index(join("commandClasses", name), i), "无效的正则 %s", p)
+			}
+		}
+	}
+	names := make([]string, len(windows))
+	for i, cw := range windows {
+		names[i] = cw.Name
+	}
+	validateUnique(errs, "changeWindows", names)
+	for i, cw := range windows {
+		path := index("changeWindows", i)
+		for _, a := range cw.Actions {
+			if !slices.Contains([]string{ActionCmd, ActionScript, ActionKill, ActionUpload}, a) {
+				errs.add(join(path, "actions"), "不支持的操作 %s", a)
+			}
+		}
+		for _, field := range []struct {
+			name  string
+			names []string
+		}{{"classes", cw.Classes}, {"except", cw.Except}} {
+			for _, c := range field.names {
+				if _, ok := classes[c]; !ok {
+					errs.add(join(path, field.name), "未定义的命令类别 %s", c)
+				}
+			}
+		}
+		if len(cw.Windows) == 0 {
+			errs.add(join(path, "windows"), "不能为空")
+		}
+		cw.Access.validate(errs, path)
+	}
+}
@@ -0,0 +1,37 @@
+package config
+
+import "time"
+
+// CurrentAgent / CurrentProxy 每次调用时读取当前(重新加载后)的配置,
+// 用于中间件等启动时传入、长期持有配置的地方
+var (
+	CurrentAgent currentAgent
+	CurrentProxy currentProxy
+)
+
+type currentAgent struct{}
+
+func (currentAgent) GetWhiteList() []string         { return GetAgent().GetWhiteList() }
+func (currentAgent) GetTrustedProxies() []string    { return GetAgent().GetTrustedProxies() }
+func (currentAgent) GetBlackList() []string         { return GetAgent().GetBlackList() }
+func (currentAgent) GetBan() Ban                    { return GetAgent().GetBan() }
+func (currentAgent) GetBanExempt() []string         { return GetAgent().GetBanExempt() }
+func (currentAgent) GetRateLimits() []RateLimit     { return GetAgent().GetRateLimits() }
+func (currentAgent) GetHMACKeys() []HMACKey         { return GetAgent().GetHMACKeys() }
+func (currentAgent) GetProxyKeys() []ProxyKey       { return GetAgent().GetProxyKeys() }
+func (currentAgent) GetMaxClockSkew() time.Duration { return GetAgent().GetMaxClockSkew() }
+func (currentAgent) GetAudit() Audit                { return GetAgent().GetAudit() }
+func (currentAgent) GetLog() Log                    { return GetAgent().GetLog() }
+
+type currentProxy struct{}
+
+func (currentProxy) GetWhiteList() []string      { return GetProxy().GetWhiteList() }
+func (currentProxy) GetTrustedProxies() []string { return GetProxy().GetTrustedProxies() }
+func (currentProxy) GetBlackList() []string      { return GetProxy().GetBlackList() }
+func (currentProxy) GetBan() Ban                 { return GetProxy().GetBan() }
+func (currentProxy) GetBanExempt() []string      { return GetProxy().GetBanExempt() }
+func (currentProxy) GetRateLimits() []RateLimit  { return GetProxy().GetRateLimits() }
+func (currentProxy) GetAccess() Access           { return GetProxy().GetAccess() }
+func (currentProxy) GetBreakGlass() BreakGlass   { return GetProxy().GetBreakGlass() }
+func (currentProxy) GetAudit() Audit             { return GetProxy().GetAudit() }
+func (currentProxy) GetLog() Log                 { return GetProxy().GetLog() }
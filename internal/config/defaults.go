@@ -0,0 +1,185 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// applyDefaults 为零值字段设置 default 标签中的默认值, 包括切片中的结构体元素
+// 需要区分未配置和配置为0的字段使用指针类型, 只有未配置(nil)时才设置默认值
+func applyDefaults(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return applyDefaults(v.Elem())
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := applyDefaults(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			field := v.Field(i)
+			if def, ok := f.Tag.Lookup("default"); ok && field.IsZero() {
+				if err := setValue(field, def); err != nil {
+					return fmt.Errorf("字段 %s 的默认值无效: %v", f.Name, err)
+				}
+				continue
+			}
+			if err := applyDefaults(field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyEnv 使用环境变量覆盖配置, 变量名为 前缀_字段路径(yaml名称大写, 用_连接),
+// 如 CMDER_AGENT_TASKNUM、CMDER_PROXY_AUTH_USERSFILE、CMDER_PROXY_TARGETS_0_ADDRESS;
+// 字符串切片使用逗号分隔; 变量名加 _FILE 后缀时读取该文件的内容, 用于传入密钥
+func applyEnv(prefix string, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return applyEnv(prefix, v.Elem())
+		}
+		// 未配置的指针字段(如 *time.Duration)也可以由环境变量设置
+		if v.Type().Elem().Kind() == reflect.Struct {
+			return nil
+		}
+	case reflect.Struct:
+		if v.Type() != reflect.TypeOf(time.Time{}) {
+			for i := 0; i < v.NumField(); i++ {
+				f := v.Type().Field(i)
+				if !f.IsExported() {
+					continue
+				}
+				name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+				if name == "-" {
+					continue
+				}
+				if name == "" {
+					name = f.Name
+				}
+				key := prefix + "_" + strings.ToUpper(name)
+				if strings.Contains(opts, "inline") {
+					key = prefix
+				}
+				if err := applyEnv(key, v.Field(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case reflect.Slice:
+		// 结构体切片按下标覆盖已有元素
+		if v.Type().Elem().Kind() == reflect.Struct {
+			for i := 0; i < v.Len(); i++ {
+				if err := applyEnv(prefix+"_"+strconv.Itoa(i), v.Index(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case reflect.Map:
+		return nil
+	}
+
+	value, ok, err := lookupEnv(prefix)
+	if err != nil || !ok {
+		return err
+	}
+	if err := setValue(v, value); err != nil {
+		return fmt.Errorf("环境变量 %s 无效: %v", prefix, err)
+	}
+	return nil
+}
+
+// lookupEnv 读取环境变量, 未设置时读取 key_FILE 指定的文件(去掉首尾空白)
+func lookupEnv(key string) (string, bool, error) {
+	if value, ok := os.LookupEnv(key); ok {
+		return value, true, nil
+	}
+	path, ok := os.LookupEnv(key + "_FILE")
+	if !ok {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("读取 %s_FILE 指定的文件失败: %v", key, err)
+	}
+	return strings.TrimSpace(string(data)), true, nil
+}
+
+// setValue 将字符串转换为字段类型后赋值, 指针字段为nil时先分配
+func setValue(v reflect.Value, s string) error {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setValue(v.Elem(), s)
+	}
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		parts := []string{}
+		for _, p := range strings.Split(s, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				parts = append(parts, p)
+			}
+		}
+		list := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			if err := setValue(list.Index(i), p); err != nil {
+				return err
+			}
+		}
+		v.Set(list)
+	default:
+		return fmt.Errorf("不支持的类型 %s", v.Type())
+	}
+	return nil
+}
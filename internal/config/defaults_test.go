@@ -0,0 +1,113 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// load 按启动时的流程(yaml -> 环境变量 -> 默认值 -> 校验)加载配置
+func load[T any](t *testing.T, yaml string) *T {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newLoader[T](path, "CMDER_TEST").read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+const agentYAML = `
+whiteList: [127.0.0.1]
+hmacKeys: [{id: k1, secret: 0123456789abcdef0123456789abcdef}]
+`
+
+func TestTaskStateLostTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  string
+		want time.Duration
+	}{
+		{name: "default", want: 24 * time.Hour},
+		{name: "configured", yaml: "taskState: {lostTTL: 1h}", want: time.Hour},
+		// 0 表示不删除, 不能被默认值覆盖
+		{name: "zero", yaml: "taskState: {lostTTL: 0s}", want: 0},
+		{name: "env zero", env: "0s", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("CMDER_TEST_TASKSTATE_LOSTTTL", tt.env)
+			}
+			a := load[Agent](t, agentYAML+tt.yaml)
+			if got := a.TaskState.GetLostTTL(); got != tt.want {
+				t.Fatalf("lostTTL = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogRetention(t *testing.T) {
+	tests := []struct {
+		name       string
+		yaml       string
+		maxAge     time.Duration
+		maxBackups int
+	}{
+		{name: "default", maxAge: 168 * time.Hour, maxBackups: 10},
+		{name: "configured", yaml: "log: {maxAge: 24h, maxBackups: 3}", maxAge: 24 * time.Hour, maxBackups: 3},
+		// 0 表示不清理, 不能被默认值覆盖
+		{name: "zero", yaml: "log: {maxAge: 0s, maxBackups: 0}", maxAge: 0, maxBackups: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := load[Agent](t, agentYAML+tt.yaml).Log
+			if got := l.GetMaxAge(); got != tt.maxAge {
+				t.Fatalf("maxAge = %s, want %s", got, tt.maxAge)
+			}
+			if got := l.GetMaxBackups(); got != tt.maxBackups {
+				t.Fatalf("maxBackups = %d, want %d", got, tt.maxBackups)
+			}
+		})
+	}
+}
+
+const proxyYAML = `
+whiteList: [127.0.0.1]
+hmacKeys: [{id: k1, secret: 0123456789abcdef0123456789abcdef}]
+targets: [{name: web, address: "http://127.0.0.1:5544"}]
+`
+
+func TestProxyLegacyAccess(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want []AccessWindow
+	}{
+		// 未配置时不限制访问时间
+		{name: "unset", want: nil},
+		{name: "configured", yaml: "accessStartTime: 9h\naccessEndTime: 18h", want: []AccessWindow{{Start: 9 * time.Hour, End: 18 * time.Hour}}},
+		// 0h 表示零点, 不能被当作未配置
+		{name: "midnight start", yaml: "accessStartTime: 0h\naccessEndTime: 6h", want: []AccessWindow{{End: 6 * time.Hour}}},
+		{name: "only end", yaml: "accessEndTime: 6h", want: []AccessWindow{{End: 6 * time.Hour}}},
+		{name: "windows first", yaml: "accessStartTime: 9h\naccess: {windows: [{start: 1h, end: 2h}]}", want: []AccessWindow{{Start: time.Hour, End: 2 * time.Hour}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := load[Proxy](t, proxyYAML+tt.yaml).GetAccess().Windows
+			if len(got) != len(tt.want) {
+				t.Fatalf("windows = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].Start != tt.want[i].Start || got[i].End != tt.want[i].End {
+					t.Fatalf("windows = %+v, want %+v", got, tt.want)
+				}
+			}
+		})
+	}
+}
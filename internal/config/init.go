@@ -4,75 +4,124 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sync"
+	"sync/atomic"
 
 	"gopkg.in/yaml.v3"
 )
 
-// Loader 泛型配置加载器
+// loadersMu 保护首次创建加载器
+var loadersMu sync.Mutex
+
+// Loader 泛型配置加载器, 重新加载时整体替换配置
 type Loader[T any] struct {
-	Config     *T
+	config     atomic.Pointer[T]
 	configPath string
-	once       sync.Once
-	loadErr    error
+	envPrefix  string     // 环境变量前缀, 如 CMDER_AGENT
+	mu         sync.Mutex // 串行化加载
 }
 
 // newLoader 创建新的配置加载器实例
-func newLoader[T any](configPath string) *Loader[T] {
+func newLoader[T any](configPath, envPrefix string) *Loader[T] {
 	absPath, _ := filepath.Abs(configPath)
 	return &Loader[T]{
 		configPath: absPath,
+		envPrefix:  envPrefix,
 	}
 }
 
-// load 加载配置
-func (l *Loader[T]) load() error {
-	l.once.Do(func() {
-		data, err := os.ReadFile(l.configPath)
-		if err != nil {
-			l.loadErr = fmt.Errorf("读取配置文件失败: %v", err)
-			return
-		}
+// read 读取、解析并验证配置文件, 依次应用环境变量和默认值
+func (l *Loader[T]) read() (*T, error) {
+	data, err := os.ReadFile(l.configPath)
+	if err != nil {
+		return nil, fmt.Errorf("读取配置文件失败: %v", err)
+	}
 
-		var config T
-		if err := yaml.Unmarshal(data, &config); err != nil {
-			l.loadErr = fmt.Errorf("解析配置文件失败: %v", err)
-			return
-		}
+	var config T
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("解析配置文件失败: %v", err)
+	}
+	if err := applyEnv(l.envPrefix, reflect.ValueOf(&config)); err != nil {
+		return nil, err
+	}
+	if err := applyDefaults(reflect.ValueOf(&config)); err != nil {
+		return nil, err
+	}
 
-		// 调用验证方法（如果存在）
-		if validator, ok := any(&config).(interface{ Validate() error }); ok {
-			if err := validator.Validate(); err != nil {
-				l.loadErr = fmt.Errorf("配置验证失败: %v", err)
-				return
-			}
+	// 调用验证方法（如果存在）
+	if validator, ok := any(&config).(interface{ Validate() error }); ok {
+		if err := validator.Validate(); err != nil {
+			return nil, fmt.Errorf("配置验证失败:\n%v", withLines(err, data))
 		}
+	}
+	return &config, nil
+}
 
-		l.Config = &config
-	})
-
-	return l.loadErr
+// Reload 重新加载配置, 验证通过后替换当前配置并返回变更项; 失败时保留原配置
+func (l *Loader[T]) Reload() ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	config, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+	old := l.config.Swap(config)
+	if old == nil {
+		return nil, nil
+	}
+	return Diff(*old, *config), nil
 }
 
 // Get 获取配置实例
 func (l *Loader[T]) Get() *T {
-	if l.Config == nil {
-		if err := l.load(); err != nil {
-			panic(fmt.Sprintf("配置未正确加载: %v", err))
-		}
+	if c := l.config.Load(); c != nil {
+		return c
 	}
-	return l.Config
+	if _, err := l.Reload(); err != nil {
+		panic(fmt.Sprintf("配置未正确加载: %v", err))
+	}
+	return l.config.Load()
 }
 
-// getConfig 通用配置获取函数
-func getConfig[T any](loaderRef **Loader[T], path string) *T {
+// getLoader 获取加载器, 首次调用时创建并加载配置
+func getLoader[T any](loaderRef **Loader[T], path, envPrefix string) (*Loader[T], error) {
+	loadersMu.Lock()
+	defer loadersMu.Unlock()
 	if *loaderRef != nil {
-		return (*loaderRef).Get()
+		return *loaderRef, nil
 	}
-	l := newLoader[T](path)
-	if err := l.load(); err != nil {
-		panic(err)
+	l := newLoader[T](path, envPrefix)
+	if _, err := l.Reload(); err != nil {
+		return nil, err
 	}
 	*loaderRef = l
+	return l, nil
+}
+
+// getConfig 通用配置获取函数, 加载失败时panic
+func getConfig[T any](loaderRef **Loader[T], path, envPrefix string) *T {
+	l, err := getLoader(loaderRef, path, envPrefix)
+	if err != nil {
+		panic(err)
+	}
 	return l.Get()
 }
+
+// loadConfig 加载配置, 失败时返回错误
+func loadConfig[T any](loaderRef **Loader[T], path, envPrefix string) (*T, error) {
+	l, err := getLoader(loaderRef, path, envPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return l.Get(), nil
+}
+
+// Defaults 只包含默认值的配置
+func Defaults[T any]() (*T, error) {
+	var config T
+	if err := applyDefaults(reflect.ValueOf(&config)); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
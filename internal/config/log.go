@@ -0,0 +1,50 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// Log 运行日志配置, Agent和Proxy共用
+type Log struct {
+	Level      string         `yaml:"level" default:"info"`    // debug / info / warn / error
+	Format     string         `yaml:"format" default:"text"`   // text / json
+	File       string         `yaml:"file"`                    // 日志文件, 为空时输出到标准错误
+	MaxSize    int            `yaml:"maxSize" default:"100"`   // 单个文件最大大小(MB), 超过后轮转
+	MaxAge     *time.Duration `yaml:"maxAge" default:"168h"`   // 轮转文件保留时长, 0 表示不按时间清理
+	MaxBackups *int           `yaml:"maxBackups" default:"10"` // 保留的轮转文件数量, 0 表示不按数量清理
+	Compress   bool           `yaml:"compress"`                // 轮转后gzip压缩
+}
+
+// GetMaxAge 轮转文件保留时长, 0 表示不按时间清理
+func (l Log) GetMaxAge() time.Duration {
+	if l.MaxAge == nil {
+		return 0
+	}
+	return *l.MaxAge
+}
+
+// GetMaxBackups 保留的轮转文件数量, 0 表示不按数量清理
+func (l Log) GetMaxBackups() int {
+	if l.MaxBackups == nil {
+		return 0
+	}
+	return *l.MaxBackups
+}
+
+func (l Log) validate(errs *errorList, path string) {
+	if !slices.Contains([]string{"", "debug", "info", "warn", "error"}, strings.ToLower(l.Level)) {
+		errs.add(join(path, "level"), "不支持的日志级别 %s", l.Level)
+	}
+	if !slices.Contains([]string{"", "text", "json"}, l.Format) {
+		errs.add(join(path, "format"), "不支持的日志格式 %s", l.Format)
+	}
+	if l.MaxSize < 0 {
+		errs.add(join(path, "maxSize"), "不能为负数")
+	}
+	if l.GetMaxBackups() < 0 {
+		errs.add(join(path, "maxBackups"), "不能为负数")
+	}
+	validateNonNegative(errs, join(path, "maxAge"), l.GetMaxAge())
+}
@@ -11,13 +11,46 @@ type WhiteListProvider interface {
 	GetWhiteList() []string
 }
 
-// KeyProvider 提供获取安全密钥的方法
+// TrustedProxyProvider 提供可信反向代理列表
+type TrustedProxyProvider interface {
+	GetTrustedProxies() []string
+}
+
+// BanProvider 提供黑名单和自动封禁配置
+type BanProvider interface {
+	GetBlackList() []string
+	GetBan() Ban
+	GetBanExempt() []string // 从不自动封禁的地址(IP或CIDR)
+}
+
+// RateLimitProvider 提供限流规则
+type RateLimitProvider interface {
+	GetRateLimits() []RateLimit
+}
+
+// KeyProvider 提供校验请求签名的密钥
 type KeyProvider interface {
-	GetXSecurityKey() string
+	GetHMACKeys() []HMACKey
+	GetProxyKeys() []ProxyKey
+	GetMaxClockSkew() time.Duration
 }
 
 // TimeRestrictedProvider提供时间段控制访问
 type TimeRestrictedProvider interface {
-	GetAcEndTime() time.Duration
-	GetAcStartTime() time.Duration
+	GetAccess() Access
+}
+
+// AuditProvider 提供审计日志配置
+type AuditProvider interface {
+	GetAudit() Audit
+}
+
+// BreakGlassProvider 提供紧急访问配置
+type BreakGlassProvider interface {
+	GetBreakGlass() BreakGlass
+}
+
+// LogProvider 提供运行日志配置
+type LogProvider interface {
+	GetLog() Log
 }
@@ -1,62 +1,320 @@
 package config
 
 import (
-	"errors"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"slices"
+	"strings"
 	"time"
 )
 
 var (
-	// 预留命令行参数
+	// 配置文件路径, 由命令行参数 -config 设置
 	ProxyFile string
 	proxy     *Loader[Proxy]
 )
 
 type Proxy struct {
-	Addr            string        `yaml:"addr" default:"localhost:5533"`       // 监听地址
-	ReadTimeout     time.Duration `yaml:"readTimeout" default:"30m"`           // http读超时
-	WriteTimeout    time.Duration `yaml:"writeTimeout" default:"30m"`          // http写超时
-	XSecurityKey    string        `yaml:"xSecurityKey" default:"xSecurityKey"` // 密钥
-	AccessStartTime time.Duration `yaml:"accessStartTime" default:"9h"`        // 允许访问开始时间
-	AccessEndTime   time.Duration `yaml:"accessEndTime" default:"18h"`         // 允许访问结束时间
-	WhiteList       []string      `yaml:"whiteList"`                           // IP白名单
-	Targets         []Target      `yaml:"targets"`
+	Addr            string              `yaml:"addr" default:"localhost:5533"` // 监听地址
+	ReadTimeout     time.Duration       `yaml:"readTimeout" default:"30m"`     // http读超时
+	WriteTimeout    time.Duration       `yaml:"writeTimeout" default:"30m"`    // http写超时
+	DrainTimeout    time.Duration       `yaml:"drainTimeout" default:"30s"`    // 关闭时等待处理中的请求和websocket会话结束的最长时间
+	XSecurityKey    string              `yaml:"xSecurityKey"`                  // 已废弃, 未配置hmacKeys时作为签名密钥
+	HMACKeys        []HMACKey           `yaml:"hmacKeys"`                      // 请求签名密钥, 使用第一个签名
+	PrivateKey      string              `yaml:"privateKey"`                    // ed25519私钥文件, 配置后使用私钥签名代替hmacKeys
+	AccessStartTime *time.Duration      `yaml:"accessStartTime"`               // 允许访问开始时间, 未配置access.windows时生效
+	AccessEndTime   *time.Duration      `yaml:"accessEndTime"`                 // 允许访问结束时间, 未配置access.windows时生效
+	Access          Access              `yaml:"access"`                        // 允许访问的时间段、时区和节假日
+	AccessExcept    []string            `yaml:"accessExcept"`                  // 不受访问时间限制的命令类别(如只读命令)
+	ChangeWindows   []ChangeWindow      `yaml:"changeWindows"`                 // 按主机/分组/命令类别限制变更时间
+	CommandClasses  map[string][]string `yaml:"commandClasses"`                // 命令类别: 名称 -> 正则列表
+	BreakGlass      BreakGlass          `yaml:"breakGlass"`                    // 紧急访问
+	ScriptDir       string              `yaml:"scriptDir" default:"./scripts"` // 脚本库存放目录
+	ScriptRun       ScriptRun           `yaml:"scriptRun"`                     // 在多个target上执行脚本库脚本的限制
+	WhiteList       []string            `yaml:"whiteList"`                     // IP白名单
+	TrustedProxies  []string            `yaml:"trustedProxies"`                // 可信的反向代理(IP或CIDR), 只信任它们传递的客户端地址
+	BlackList       []string            `yaml:"blackList"`                     // IP黑名单(IP或CIDR), 优先于白名单
+	Ban             Ban                 `yaml:"ban"`                           // 认证失败自动封禁
+	RateLimits      []RateLimit         `yaml:"rateLimits"`                    // 限流规则
+	Targets         []Target            `yaml:"targets"`
+	Audit           Audit               `yaml:"audit"`    // 审计日志
+	Log             Log                 `yaml:"log"`      // 运行日志
+	Auth            Auth                `yaml:"auth"`     // 控制台用户登录
+	Roles           []Role              `yaml:"roles"`    // 角色权限, 为空时不做权限控制
+	TLS             TLS                 `yaml:"tls"`      // 控制台https
+	AgentTLS        AgentTLS            `yaml:"agentTLS"` // 连接https agent的客户端配置
+}
+
+// Auth 控制台登录配置, UsersFile 为空时不启用登录
+type Auth struct {
+	UsersFile    string        `yaml:"usersFile"`                          // 用户文件(bcrypt密码)
+	SessionTTL   time.Duration `yaml:"sessionTTL" default:"8h"`            // 会话最长有效期
+	IdleTimeout  time.Duration `yaml:"idleTimeout" default:"30m"`          // 会话空闲超时
+	SecureCookie bool          `yaml:"secureCookie" default:"false"`       // 强制Secure cookie(proxy前有https反向代理时开启)
+	TokensFile   string        `yaml:"tokensFile" default:"./tokens.json"` // API令牌文件(只保存哈希)
 }
 
 type Target struct {
-	Name    string `yaml:"name"`
-	Address string `yaml:"address"`
+	Name       string   `yaml:"name"`
+	Address    string   `yaml:"address"`    // agent地址, https 地址使用TLS连接
+	Groups     []string `yaml:"groups"`     // 所属分组, 用于按组授权
+	CA         string   `yaml:"ca"`         // 固定校验该agent证书的CA, 为空时使用 agentTLS.ca
+	ServerName string   `yaml:"serverName"` // 校验证书时使用的主机名, 为空时使用地址中的主机名
+	KeyPins    []string `yaml:"keyPins"`    // 固定agent证书公钥: base64(sha256(SubjectPublicKeyInfo)), 任一匹配即可
+}
+
+// 角色可授予的操作
+const (
+	ActionView   = "view"   // 查看主机、任务列表和任务输出
+	ActionCmd    = "cmd"    // 执行命令
+	ActionScript = "script" // 执行脚本
+	ActionKill   = "kill"   // 终止任务
+	ActionUpload = "upload" // 上传文件
+)
+
+// Role 角色, Admin 拥有全部权限(包括审计查询和脚本库管理)
+type Role struct {
+	Name       string `yaml:"name"`
+	Admin      bool   `yaml:"admin"`
+	BreakGlass bool   `yaml:"breakGlass"` // 允许在访问时间和变更窗口之外申请紧急访问
+	Rules      []Rule `yaml:"rules"`
+}
+
+// BreakGlass 紧急访问: 有权限的用户填写原因后立即获得临时访问, 不受访问时间和变更窗口限制
+type BreakGlass struct {
+	MaxDuration time.Duration `yaml:"maxDuration" default:"4h"`         // 单次最长时长
+	RequireAck  bool          `yaml:"requireAck"`                       // 是否需要另一位管理员事后确认, 未确认前不能再次申请
+	File        string        `yaml:"file" default:"./breakglass.json"` // 紧急访问记录文件
+}
+
+// ScriptRun 执行脚本库脚本的限制, 所有target的输出在请求结束时一起返回, 需要限制内存占用
+type ScriptRun struct {
+	MaxTargets int `yaml:"maxTargets" default:"20"`  // 单次请求最多的target数量
+	MaxOutput  int `yaml:"maxOutput" default:"1024"` // 单个target最多保留的输出(KB), 超过部分丢弃
+}
+
+// Rule 授权规则
+// Targets 支持主机名、"group:分组名" 和 "*"; Actions 支持上面的操作和 "*"
+type Rule struct {
+	Targets []string `yaml:"targets"`
+	Actions []string `yaml:"actions"`
 }
 
 func (p *Proxy) Validate() error {
-	if p.Addr == "" {
-		return errors.New("监听地址不能为空")
-	}
+	var errs errorList
+	validateAddr(&errs, "addr", p.Addr)
+	validateNonNegative(&errs, "readTimeout", p.ReadTimeout)
+	validateNonNegative(&errs, "writeTimeout", p.WriteTimeout)
+	validateNonNegative(&errs, "drainTimeout", p.DrainTimeout)
 	if len(p.Targets) == 0 {
-		return errors.New("目标主机配置不能为空")
+		errs.add("targets", "目标主机配置不能为空")
 	}
+	p.validateTargets(&errs)
 	if len(p.WhiteList) == 0 {
-		return errors.New("主机白名单列表不能为空")
+		errs.add("whiteList", "主机白名单列表不能为空")
+	}
+	validateNets(&errs, "whiteList", p.WhiteList)
+	validateNets(&errs, "trustedProxies", p.TrustedProxies)
+	validateNets(&errs, "blackList", p.BlackList)
+	for _, f := range []struct {
+		path string
+		d    *time.Duration
+	}{{"accessStartTime", p.AccessStartTime}, {"accessEndTime", p.AccessEndTime}} {
+		if f.d != nil && (*f.d < 0 || *f.d > 24*time.Hour) {
+			errs.add(f.path, "需在 0~24h 之间: %s", *f.d)
+		}
+	}
+	p.Access.validate(&errs, "access")
+	for _, c := range p.AccessExcept {
+		if _, ok := p.CommandClasses[c]; !ok {
+			errs.add("accessExcept", "未定义的命令类别 %s", c)
+		}
+	}
+	validateChangeWindows(&errs, p.ChangeWindows, p.CommandClasses)
+	for i, cw := range p.ChangeWindows {
+		p.checkTargetRefs(join(index("changeWindows", i), "targets"), cw.Targets)
+	}
+	p.validateRoles(&errs)
+	p.Ban.validate(&errs, "ban")
+	validateRateLimits(&errs, p.RateLimits)
+	p.TLS.validate(&errs, "tls")
+	p.AgentTLS.validate(&errs, "agentTLS")
+	p.Audit.validate(&errs, "audit")
+	p.Log.validate(&errs, "log")
+	validateNonNegative(&errs, "auth.sessionTTL", p.Auth.SessionTTL)
+	validateNonNegative(&errs, "auth.idleTimeout", p.Auth.IdleTimeout)
+	validateNonNegative(&errs, "breakGlass.maxDuration", p.BreakGlass.MaxDuration)
+	if p.ScriptRun.MaxTargets <= 0 {
+		errs.add("scriptRun.maxTargets", "必须大于0")
+	}
+	if p.ScriptRun.MaxOutput <= 0 {
+		errs.add("scriptRun.maxOutput", "必须大于0")
+	}
+	if p.PrivateKey == "" {
+		validateHMACKeys(&errs, p.HMACKeys, p.XSecurityKey)
+	}
+	return errs.err()
+}
+
+// validateTargets 校验主机: 名称不重复, 地址为http(s)地址, 公钥固定值格式正确
+func (p *Proxy) validateTargets(errs *errorList) {
+	names := make([]string, len(p.Targets))
+	for i, t := range p.Targets {
+		names[i] = t.Name
+	}
+	validateUnique(errs, "targets", names)
+	for i, t := range p.Targets {
+		path := index("targets", i)
+		u, err := url.Parse(t.Address)
+		switch {
+		case t.Address == "":
+			errs.add(join(path, "address"), "不能为空")
+		case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+			errs.add(join(path, "address"), "无效的地址 %s, 格式为 http(s)://host:port", t.Address)
+		case u.Path != "" && u.Path != "/":
+			errs.add(join(path, "address"), "地址不能包含路径: %s", t.Address)
+		}
+		if len(t.KeyPins) > 0 && !strings.HasPrefix(t.Address, "https://") {
+			errs.add(join(path, "keyPins"), "配置了keyPins, 地址必须为https")
+		}
+		for j, pin := range t.KeyPins {
+			if raw, err := base64.StdEncoding.DecodeString(pin); err != nil || len(raw) != sha256.Size {
+				errs.add(index(join(path, "keyPins"), j), "需为base64编码的sha256值")
+			}
+		}
+		for j, g := range t.Groups {
+			if g == "" || strings.ContainsAny(g, " :") {
+				errs.add(index(join(path, "groups"), j), "无效的分组名 %q", g)
+			}
+		}
+	}
+}
+
+// validateRoles 校验角色: 名称不重复, 操作有效
+func (p *Proxy) validateRoles(errs *errorList) {
+	names := make([]string, len(p.Roles))
+	for i, r := range p.Roles {
+		names[i] = r.Name
+	}
+	validateUnique(errs, "roles", names)
+	actions := []string{"*", ActionView, ActionCmd, ActionScript, ActionKill, ActionUpload}
+	for i, r := range p.Roles {
+		for j, rule := range r.Rules {
+			path := index(join(index("roles", i), "rules"), j)
+			for _, a := range rule.Actions {
+				if !slices.Contains(actions, a) {
+					errs.add(join(path, "actions"), "不支持的操作 %s", a)
+				}
+			}
+			p.checkTargetRefs(join(path, "targets"), rule.Targets)
+		}
+	}
+}
+
+// checkTargetRefs 引用了不存在的主机或分组时提示, 不视为错误(主机可能稍后添加)
+func (p *Proxy) checkTargetRefs(path string, refs []string) {
+	for _, ref := range refs {
+		if ref == "*" {
+			continue
+		}
+		found := slices.ContainsFunc(p.Targets, func(t Target) bool {
+			if group, ok := strings.CutPrefix(ref, "group:"); ok {
+				return slices.Contains(t.Groups, group)
+			}
+			return t.Name == ref
+		})
+		if !found {
+			warn(path, "没有匹配 %s 的主机", ref)
+		}
 	}
-	return nil
 }
 
 func (p *Proxy) GetWhiteList() []string {
 	return p.WhiteList
 }
 
+func (p *Proxy) GetTrustedProxies() []string {
+	return p.TrustedProxies
+}
+
+func (p *Proxy) GetBlackList() []string {
+	return p.BlackList
+}
+
+func (p *Proxy) GetBan() Ban {
+	return p.Ban
+}
+
+// GetBanExempt 可信反向代理转发了所有用户的请求, 不自动封禁
+func (p *Proxy) GetBanExempt() []string {
+	return p.TrustedProxies
+}
+
+func (p *Proxy) GetRateLimits() []RateLimit {
+	return p.RateLimits
+}
+
 func (p *Proxy) GetXSecurityKey() string {
 	return p.XSecurityKey
 }
-func (p *Proxy) GetAcStartTime() time.Duration {
-	return p.AccessStartTime
+
+// GetSignKey 用于签名转发请求的密钥
+func (p *Proxy) GetSignKey() HMACKey {
+	return hmacKeys(p.HMACKeys, p.XSecurityKey)[0]
 }
-func (p *Proxy) GetAcEndTime() time.Duration {
-	return p.AccessEndTime
+
+// GetAccess 允许访问的时间
+// 未配置access.windows时兼容 accessStartTime/accessEndTime(未配置的一项按0h), 都未配置时不限制
+func (p *Proxy) GetAccess() Access {
+	a := p.Access
+	if len(a.Windows) == 0 && (p.AccessStartTime != nil || p.AccessEndTime != nil) {
+		var w AccessWindow
+		if p.AccessStartTime != nil {
+			w.Start = *p.AccessStartTime
+		}
+		if p.AccessEndTime != nil {
+			w.End = *p.AccessEndTime
+		}
+		a.Windows = []AccessWindow{w}
+	}
+	return a
+}
+
+// GetScriptDir 脚本库目录
+func (p *Proxy) GetScriptDir() string {
+	return p.ScriptDir
+}
+
+func (p *Proxy) GetLog() Log {
+	return p.Log
+}
+
+func (p *Proxy) GetAudit() Audit {
+	return p.Audit
+}
+
+// GetAuth 登录配置
+func (p *Proxy) GetAuth() Auth {
+	return p.Auth
+}
+
+// GetBreakGlass 紧急访问配置
+func (p *Proxy) GetBreakGlass() BreakGlass {
+	return p.BreakGlass
 }
 
 func GetProxy() *Proxy {
 	if ProxyFile == "" {
 		ProxyFile = "./config.yaml"
 	}
-	return getConfig(&proxy, ProxyFile)
+	return getConfig(&proxy, ProxyFile, "CMDER_PROXY")
+}
+
+// LoadProxy 加载配置, 与 GetProxy 相同但失败时返回错误
+func LoadProxy() (*Proxy, error) {
+	if ProxyFile == "" {
+		ProxyFile = "./config.yaml"
+	}
+	return loadConfig(&proxy, ProxyFile, "CMDER_PROXY")
 }
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// 限流维度
+const (
+	LimitByIP     = "ip"
+	LimitByUser   = "user"   // 未登录时按IP
+	LimitByTarget = "target" // 请求参数 name
+)
+
+// RateLimit 一条限流规则(令牌桶), 匹配的规则全部生效
+type RateLimit struct {
+	Route    string        `yaml:"route"`    // 路由, 格式同 http.ServeMux: [方法 ]路径前缀, 如 "POST /api/cmd/add"; 为空匹配所有
+	By       []string      `yaml:"by"`       // 限流维度: ip / user / target, 多个维度组合为一个桶
+	Requests int           `yaml:"requests"` // 每个周期允许的请求数
+	Per      time.Duration `yaml:"per"`      // 周期
+	Burst    int           `yaml:"burst"`    // 突发请求数, 默认等于requests
+}
+
+// validateRateLimits 校验限流规则
+func validateRateLimits(errs *errorList, limits []RateLimit) {
+	for i, l := range limits {
+		path := index("rateLimits", i)
+		route := l.Route
+		if method, rest, ok := strings.Cut(route, " "); ok {
+			if method == "" || strings.ToUpper(method) != method {
+				errs.add(join(path, "route"), "无效的方法 %s, 需为大写, 如 POST", method)
+			}
+			route = strings.TrimSpace(rest)
+		}
+		if route != "" && !strings.HasPrefix(route, "/") {
+			errs.add(join(path, "route"), "路径需以 / 开头: %s", l.Route)
+		}
+		if l.Requests <= 0 {
+			errs.add(join(path, "requests"), "必须大于0")
+		}
+		if l.Per <= 0 {
+			errs.add(join(path, "per"), "必须大于0")
+		}
+		if l.Burst < 0 {
+			errs.add(join(path, "burst"), "不能小于0")
+		}
+		if len(l.By) == 0 {
+			errs.add(join(path, "by"), "不能为空")
+		}
+		for _, by := range l.By {
+			if !slices.Contains([]string{LimitByIP, LimitByUser, LimitByTarget}, by) {
+				errs.add(join(path, "by"), "不支持的维度 %s", by)
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReloadAgent 重新加载agent配置, 返回变更项; 失败时继续使用原配置
+func ReloadAgent() ([]string, error) {
+	if _, err := LoadAgent(); err != nil {
+		return nil, err
+	}
+	return agent.Reload()
+}
+
+// ReloadProxy 重新加载proxy配置, 返回变更项; 失败时继续使用原配置
+func ReloadProxy() ([]string, error) {
+	if _, err := LoadProxy(); err != nil {
+		return nil, err
+	}
+	return proxy.Reload()
+}
+
+// Watch 每隔interval检查配置文件, 修改时间或大小变化时调用reload, 直到stop关闭
+// 编辑器保存时可能先删除再创建文件, 文件暂时不存在时忽略
+func Watch(path string, interval time.Duration, stop <-chan struct{}, reload func()) {
+	stat := func() (time.Time, int64, bool) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, 0, false
+		}
+		return fi.ModTime(), fi.Size(), true
+	}
+	mod, size, _ := stat()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m, s, ok := stat()
+			if !ok || (m.Equal(mod) && s == size) {
+				continue
+			}
+			mod, size = m, s
+			slog.Info("配置文件已修改", slog.String("File", path))
+			reload()
+		}
+	}
+}
+
+// Diff 比较两份配置, 返回变更项, 如 "targets[1].address: a -> b"
+// 密钥类字段只提示已修改, 不输出内容
+func Diff(old, new any) []string {
+	a, b := map[string]string{}, map[string]string{}
+	flatten("", reflect.ValueOf(old), a)
+	flatten("", reflect.ValueOf(new), b)
+	var changes []string
+	for k, v := range a {
+		nv, ok := b[k]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("%s: 删除 %s", k, mask(k, v)))
+		case nv != v && isSecret(k):
+			changes = append(changes, k+": 已修改")
+		case nv != v:
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", k, v, nv))
+		}
+	}
+	for k, v := range b {
+		if _, ok := a[k]; !ok {
+			changes = append(changes, fmt.Sprintf("%s: 新增 %s", k, mask(k, v)))
+		}
+	}
+	slices.Sort(changes)
+	return changes
+}
+
+// flatten 按yaml字段名展开配置, 叶子节点输出为字符串
+func flatten(prefix string, v reflect.Value, out map[string]string) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			flatten(prefix, v.Elem(), out)
+		}
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			out[prefix] = fmt.Sprint(v.Interface())
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			if strings.Contains(opts, "inline") {
+				flatten(prefix, v.Field(i), out)
+				continue
+			}
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			flatten(name, v.Field(i), out)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			flatten(fmt.Sprintf("%s[%d]", prefix, i), v.Index(i), out)
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			flatten(fmt.Sprintf("%s[%v]", prefix, k.Interface()), v.MapIndex(k), out)
+		}
+	case reflect.String:
+		out[prefix] = strconv.Quote(v.String())
+	default:
+		out[prefix] = fmt.Sprint(v.Interface())
+	}
+}
+
+// isSecret 是否为密钥类字段
+func isSecret(key string) bool {
+	key = strings.ToLower(key)
+	return strings.HasSuffix(key, ".secret") || strings.HasSuffix(key, "securitykey")
+}
+
+func mask(key, v string) string {
+	if isSecret(key) {
+		return "***"
+	}
+	return v
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+)
+
+// HMACKey proxy与agent之间的请求签名密钥
+type HMACKey struct {
+	Id     string `yaml:"id"`     // 密钥标识, 随请求发送
+	Secret string `yaml:"secret"` // 共享密钥
+}
+
+// ProxyKey agent信任的proxy公钥
+type ProxyKey struct {
+	Name      string `yaml:"name"`      // 说明, 用于日志
+	PublicKey string `yaml:"publicKey"` // ed25519公钥(base64), 由 cmd-proxy keygen 生成
+}
+
+// Decode 解码公钥
+func (k ProxyKey) Decode() (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(k.PublicKey)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("proxy公钥 %s 格式错误", k.Name)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+func validateProxyKeys(errs *errorList, keys []ProxyKey) {
+	for i, k := range keys {
+		if _, err := k.Decode(); err != nil {
+			errs.add(join(index("proxyKeys", i), "publicKey"), "%v", err)
+		}
+	}
+}
+
+// defaultKeyId 兼容旧配置: 只配置了 xSecurityKey 时使用的密钥标识
+const defaultKeyId = "default"
+
+// hmacKeys 返回签名密钥, 未配置时使用 xSecurityKey
+func hmacKeys(keys []HMACKey, legacy string) []HMACKey {
+	if len(keys) == 0 && legacy != "" {
+		return []HMACKey{{Id: defaultKeyId, Secret: legacy}}
+	}
+	return keys
+}
+
+// validateHMACKeys 校验签名密钥: 标识不重复, 密钥长度不小于16且不能过于简单
+// 未配置 hmacKeys 时要求配置 xSecurityKey
+func validateHMACKeys(errs *errorList, keys []HMACKey, legacy string) {
+	if len(keys) == 0 {
+		if legacy == "" {
+			errs.add("hmacKeys", "请求签名密钥不能为空")
+		} else if len(legacy) < 16 {
+			warn("xSecurityKey", "已废弃且长度小于16, 建议改用 hmacKeys")
+		}
+		return
+	}
+	seen := make(map[string]bool, len(keys))
+	for i, k := range keys {
+		path := index("hmacKeys", i)
+		switch {
+		case k.Id == "":
+			errs.add(join(path, "id"), "不能为空")
+		case seen[k.Id]:
+			errs.add(join(path, "id"), "签名密钥 %s 重复", k.Id)
+		}
+		seen[k.Id] = true
+		if len(k.Secret) < 16 {
+			errs.add(join(path, "secret"), "长度不能小于16")
+		} else if weakSecret(k.Secret) {
+			errs.add(join(path, "secret"), "过于简单, 请使用随机生成的密钥, 如: openssl rand -base64 24")
+		}
+	}
+}
+
+// weakSecret 不同字符少于8个的密钥视为过于简单, 如 aaaaaaaaaaaaaaaa / 1234567812345678
+func weakSecret(secret string) bool {
+	chars := map[rune]bool{}
+	for _, c := range secret {
+		chars[c] = true
+	}
+	return len(chars) < 8
+}
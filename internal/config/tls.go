@@ -0,0 +1,47 @@
+package config
+
+import "slices"
+
+// TLS 服务端TLS配置, CertFile为空时使用明文http
+type TLS struct {
+	CertFile   string `yaml:"certFile"`                 // 服务端证书(PEM)
+	KeyFile    string `yaml:"keyFile"`                  // 服务端私钥(PEM)
+	MinVersion string `yaml:"minVersion" default:"1.2"` // 最低TLS版本: 1.2 / 1.3
+	ClientCA   string `yaml:"clientCA"`                 // 客户端证书CA, 配置后要求客户端证书(mTLS)
+}
+
+// Enabled 是否启用TLS
+func (t TLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+func (t TLS) validate(errs *errorList, path string) {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs.add(path, "certFile 和 keyFile 必须同时配置")
+	}
+	if t.ClientCA != "" && !t.Enabled() {
+		errs.add(join(path, "clientCA"), "配置 clientCA 时必须同时配置证书")
+	}
+	validateTLSVersion(errs, join(path, "minVersion"), t.MinVersion)
+}
+
+// AgentTLS proxy连接https agent时使用的客户端TLS配置
+type AgentTLS struct {
+	CertFile   string `yaml:"certFile"`                 // 客户端证书(agent要求mTLS时出示)
+	KeyFile    string `yaml:"keyFile"`                  // 客户端私钥
+	CA         string `yaml:"ca"`                       // 校验agent证书的CA, 为空时使用系统根证书
+	MinVersion string `yaml:"minVersion" default:"1.2"` // 最低TLS版本
+}
+
+func (t AgentTLS) validate(errs *errorList, path string) {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs.add(path, "certFile 和 keyFile 必须同时配置")
+	}
+	validateTLSVersion(errs, join(path, "minVersion"), t.MinVersion)
+}
+
+func validateTLSVersion(errs *errorList, path, v string) {
+	if v != "" && !slices.Contains([]string{"1.2", "1.3"}, v) {
+		errs.add(path, "不支持的TLS版本: %s", v)
+	}
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FieldError 配置项错误, Path 为yaml中的路径, 如 targets[1].address
+type FieldError struct {
+	Path string
+	Line int // 在配置文件中的行号, 0表示未知(如未配置的项)
+	Msg  string
+}
+
+func (e *FieldError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("第%d行 %s: %s", e.Line, e.Path, e.Msg)
+	}
+	if e.Path == "" {
+		return e.Msg
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Msg)
+}
+
+// errorList 收集验证中发现的全部错误
+type errorList []*FieldError
+
+func (l *errorList) add(path, format string, args ...any) {
+	*l = append(*l, &FieldError{Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (l errorList) err() error {
+	errs := make([]error, len(l))
+	for i, e := range l {
+		errs[i] = e
+	}
+	return errors.Join(errs...)
+}
+
+// warn 不影响使用但建议修改的配置
+func warn(path, format string, args ...any) {
+	slog.Warn("配置建议", slog.String("Path", path), slog.String("Msg", fmt.Sprintf(format, args...)))
+}
+
+// join 拼接yaml路径
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func index(path string, i int) string {
+	return path + "[" + strconv.Itoa(i) + "]"
+}
+
+// validateAddr 校验监听地址 host:port
+func validateAddr(errs *errorList, path, addr string) {
+	if addr == "" {
+		errs.add(path, "监听地址不能为空")
+		return
+	}
+	if _, port, err := net.SplitHostPort(addr); err != nil {
+		errs.add(path, "无效的监听地址 %s, 格式为 host:port", addr)
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		errs.add(path, "无效的端口 %s", port)
+	}
+}
+
+// validateNonNegative 校验时长不能为负数
+func validateNonNegative(errs *errorList, path string, d time.Duration) {
+	if d < 0 {
+		errs.add(path, "不能为负数: %s", d)
+	}
+}
+
+// validateNets 校验IP或CIDR列表
+func validateNets(errs *errorList, path string, entries []string) {
+	for i, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if _, _, err := net.ParseCIDR(entry); err == nil || net.ParseIP(entry) != nil {
+			continue
+		}
+		errs.add(index(path, i), "无效的IP或CIDR: %s", entry)
+	}
+}
+
+// validateUnique 校验名称不为空且不重复
+func validateUnique(errs *errorList, path string, names []string) {
+	seen := make(map[string]bool, len(names))
+	for i, name := range names {
+		switch {
+		case name == "":
+			errs.add(join(index(path, i), "name"), "名称不能为空")
+		case seen[name]:
+			errs.add(join(index(path, i), "name"), "名称 %s 重复", name)
+		}
+		seen[name] = true
+	}
+}
+
+// withLines 为验证错误补充配置文件中的行号
+func withLines(err error, data []byte) error {
+	var root yaml.Node
+	if yaml.Unmarshal(data, &root) != nil {
+		return err
+	}
+	var list []error
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		list = joined.Unwrap()
+	} else {
+		list = []error{err}
+	}
+	for _, e := range list {
+		var fe *FieldError
+		if errors.As(e, &fe) && fe.Line == 0 {
+			fe.Line = lineOf(&root, fe.Path)
+		}
+	}
+	return err
+}
+
+// lineOf 查找yaml路径所在的行, 路径不存在时返回最近的上级所在的行
+func lineOf(root *yaml.Node, path string) int {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := 0
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '.' || r == '[' }) {
+		child, at := childOf(node, part)
+		if child == nil {
+			break
+		}
+		node, line = child, at
+	}
+	return line
+}
+
+// childOf 对象中的键(返回键所在的行)或列表中的元素, 如 "targets" "1]"
+func childOf(node *yaml.Node, part string) (*yaml.Node, int) {
+	if i, err := strconv.Atoi(strings.TrimSuffix(part, "]")); err == nil && strings.HasSuffix(part, "]") {
+		if node.Kind == yaml.SequenceNode && i < len(node.Content) {
+			return node.Content[i], node.Content[i].Line
+		}
+		return nil, 0
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil, 0
+	}
+	for j := 0; j+1 < len(node.Content); j += 2 {
+		if node.Content[j].Value == part {
+			return node.Content[j+1], node.Content[j].Line
+		}
+	}
+	return nil, 0
+}
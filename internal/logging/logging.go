@@ -0,0 +1,159 @@
+// logging 运行日志: 按配置设置slog的级别、格式和输出文件
+// 请求相关的属性(请求ID、用户、目标主机、任务ID)由中间件写入上下文, 使用 slog.XxxContext 输出时自动附加
+
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"cmder/internal/config"
+)
+
+var (
+	level = new(slog.LevelVar)
+
+	mu      sync.Mutex
+	current *config.Log // 已生效的配置, 未调用Setup时为nil
+	output  *Writer     // 日志文件, 输出到标准错误时为nil
+)
+
+// Setup 按配置设置默认logger, 可重复调用(重新加载配置时)
+// 只有级别或轮转参数变化时不重新创建handler
+func Setup(cfg config.Log) error {
+	lvl, err := parseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	level.Set(lvl)
+	if current != nil && current.File == cfg.File && current.Format == cfg.Format {
+		if output != nil {
+			output.configure(cfg)
+		}
+		current = &cfg
+		return nil
+	}
+
+	var w io.Writer = os.Stderr
+	var file *Writer
+	if cfg.File != "" {
+		if file, err = NewWriter(cfg); err != nil {
+			return err
+		}
+		w = file
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	if cfg.Format == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(&handler{Handler: h}))
+
+	old := output
+	output, current = file, &cfg
+	if old != nil {
+		_ = old.Close()
+	}
+	return nil
+}
+
+// Close 关闭日志文件, 之后的日志输出到标准错误
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if output == nil {
+		return nil
+	}
+	slog.SetDefault(slog.New(&handler{Handler: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})}))
+	err := output.Close()
+	output, current = nil, nil
+	return err
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := l.UnmarshalText([]byte(strings.ToUpper(s))); err != nil {
+		return l, fmt.Errorf("不支持的日志级别 %s", s)
+	}
+	return l, nil
+}
+
+// ---------------- 上下文属性 ----------------
+
+type ctxKey struct{}
+
+// fields 一个请求的日志属性, 处理过程中可以追加(如创建任务后得到的任务ID)
+type fields struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+// With 返回带有日志属性的上下文, 继承父上下文已有的属性
+func With(ctx context.Context, attrs ...slog.Attr) context.Context {
+	f := &fields{}
+	if parent, ok := ctx.Value(ctxKey{}).(*fields); ok {
+		f.attrs = parent.get()
+	}
+	f.attrs = append(f.attrs, attrs...)
+	return context.WithValue(ctx, ctxKey{}, f)
+}
+
+// Add 向上下文中已有的日志属性追加(同名覆盖), 上下文没有日志属性时忽略
+func Add(ctx context.Context, attrs ...slog.Attr) {
+	f, ok := ctx.Value(ctxKey{}).(*fields)
+	if !ok {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, a := range attrs {
+		i := 0
+		for ; i < len(f.attrs); i++ {
+			if f.attrs[i].Key == a.Key {
+				f.attrs[i] = a
+				break
+			}
+		}
+		if i == len(f.attrs) {
+			f.attrs = append(f.attrs, a)
+		}
+	}
+}
+
+func (f *fields) get() []slog.Attr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]slog.Attr(nil), f.attrs...)
+}
+
+// handler 输出时附加上下文中的日志属性
+type handler struct {
+	slog.Handler
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if f, ok := ctx.Value(ctxKey{}).(*fields); ok {
+		r.AddAttrs(f.get()...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &handler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{Handler: h.Handler.WithGroup(name)}
+}
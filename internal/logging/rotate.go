@@ -0,0 +1,230 @@
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cmder/internal/config"
+)
+
+// backupLayout 轮转文件名中的时间格式, 与审计文件一致
+const backupLayout = "20060102T150405.000000"
+
+// Writer 按大小轮转的日志文件, 轮转后的文件按配置压缩, 并按保留时长和数量清理
+type Writer struct {
+	mu   sync.Mutex
+	path string
+	cfg  config.Log
+	file *os.File
+	size int64
+	mill chan struct{} // 通知后台压缩和清理轮转文件
+	done chan struct{}
+}
+
+// NewWriter 打开(或创建)日志文件
+func NewWriter(cfg config.Log) (*Writer, error) {
+	path, err := filepath.Abs(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("创建日志目录失败: %v", err)
+	}
+	w := &Writer{
+		path: path,
+		cfg:  cfg,
+		mill: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	go w.millLoop()
+	// 启动时处理上次遗留的轮转文件
+	w.mill <- struct{}{}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("打开日志文件失败: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+// configure 更新轮转参数, 日志文件路径不变
+func (w *Writer) configure(cfg config.Log) {
+	w.mu.Lock()
+	w.cfg = cfg
+	w.mu.Unlock()
+	w.notify()
+}
+
+// Write 写入一条日志, 写入后超过大小限制时先轮转
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	if max := int64(w.cfg.MaxSize) << 20; max > 0 && w.size > 0 && w.size+int64(len(p)) > max {
+		if err := w.rotate(); err != nil {
+			// 不能再写日志, 直接输出到标准错误
+			fmt.Fprintf(os.Stderr, "日志文件轮转失败: %v\n", err)
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotate 将当前文件重命名为带时间戳的备份并打开新文件, 调用方需持有锁
+func (w *Writer) rotate() error {
+	backup := w.path + "." + time.Now().Format(backupLayout)
+	if err := os.Rename(w.path, backup); err != nil {
+		return err
+	}
+	old := w.file
+	if err := w.open(); err != nil {
+		return err
+	}
+	_ = old.Close()
+	w.notify()
+	return nil
+}
+
+func (w *Writer) notify() {
+	select {
+	case w.mill <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Writer) millLoop() {
+	defer close(w.done)
+	for range w.mill {
+		w.mu.Lock()
+		cfg := w.cfg
+		w.mu.Unlock()
+		if err := w.millOnce(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "清理日志文件失败: %v\n", err)
+		}
+	}
+}
+
+// backup 一个轮转文件
+type backup struct {
+	path string
+	time time.Time
+}
+
+// millOnce 压缩未压缩的轮转文件, 删除过期和超出数量的轮转文件
+func (w *Writer) millOnce(cfg config.Log) error {
+	files, err := w.backups()
+	if err != nil {
+		return err
+	}
+	var keep []backup
+	maxAge, maxBackups := cfg.GetMaxAge(), cfg.GetMaxBackups()
+	for i, b := range files {
+		expired := maxAge > 0 && time.Since(b.time) > maxAge
+		excess := maxBackups > 0 && len(files)-i > maxBackups
+		if expired || excess {
+			if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		keep = append(keep, b)
+	}
+	if !cfg.Compress {
+		return nil
+	}
+	for _, b := range keep {
+		if strings.HasSuffix(b.path, ".gz") {
+			continue
+		}
+		if err := compress(b.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backups 按时间升序返回轮转文件, 忽略不符合命名格式的文件
+func (w *Writer) backups() ([]backup, error) {
+	files, err := filepath.Glob(w.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var list []backup
+	for _, f := range files {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(f, w.path+"."), ".gz")
+		t, err := time.ParseInLocation(backupLayout, stamp, time.Local)
+		if err != nil {
+			continue
+		}
+		list = append(list, backup{path: f, time: t})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].time.Before(list[j].time) })
+	return list, nil
+}
+
+// compress 将文件压缩为 .gz 并删除原文件
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Close 关闭日志文件并等待后台清理结束
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	if w.file == nil {
+		w.mu.Unlock()
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	close(w.mill)
+	w.mu.Unlock()
+	<-w.done
+	return err
+}
@@ -0,0 +1,219 @@
+// Package metrics 以Prometheus文本格式输出监控指标
+//
+// 只实现了用到的 counter、gauge 和 histogram, 避免引入客户端库
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric 一个指标, 注册后输出时按注册顺序写出
+type Metric interface {
+	write(w io.Writer)
+}
+
+var (
+	mu       sync.Mutex
+	registry []Metric
+)
+
+// Register 注册指标, 只有注册的指标才在 /metrics 输出
+// agent和proxy各自注册自己的指标, 避免输出另一方的指标
+func Register(ms ...Metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry = append(registry, ms...)
+}
+
+// Handler 输出全部指标
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mu.Lock()
+	list := slices.Clone(registry)
+	mu.Unlock()
+	for _, m := range list {
+		m.write(w)
+	}
+	writeRuntime(w)
+}
+
+// vec 按标签值保存的一组序列
+type vec[T any] struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	keys       []string // 保持输出顺序稳定
+	values     map[string]*T
+}
+
+func newVec[T any](name, help string, labels []string) vec[T] {
+	return vec[T]{name: name, help: help, labels: labels, values: map[string]*T{}}
+}
+
+// get 获取标签值对应的序列, 调用方需持有锁
+func (v *vec[T]) get(labelValues []string, init func() *T) *T {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("指标 %s 需要 %d 个标签值", v.name, len(v.labels)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.values[key]
+	if !ok {
+		s = init()
+		v.values[key] = s
+		v.keys = append(v.keys, key)
+	}
+	return s
+}
+
+// labelString 输出 {a="1",b="2"}, extra 为追加的标签如 le
+func (v *vec[T]) labelString(key string, extra ...string) string {
+	var values []string
+	if len(v.labels) > 0 {
+		values = strings.Split(key, "\xff")
+	}
+	pairs := make([]string, 0, len(v.labels)+1)
+	for i, l := range v.labels {
+		pairs = append(pairs, l+"="+quote(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func quote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+	return `"` + s + `"`
+}
+
+func header(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// ---------------- counter ----------------
+
+// Counter 只增不减的计数
+type Counter struct {
+	vec[float64]
+}
+
+// NewCounter 创建计数器, labels 为标签名
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{newVec[float64](name, help, labels)}
+}
+
+// Inc 计数加1
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add 计数增加n
+func (c *Counter) Add(n float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*c.get(labelValues, func() *float64 { return new(float64) }) += n
+}
+
+func (c *Counter) write(w io.Writer) {
+	header(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range c.keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(key), formatFloat(*c.values[key]))
+	}
+}
+
+// ---------------- gauge ----------------
+
+// GaugeFunc 输出时调用fn获取当前值, fn 通过 emit 输出每个序列
+type GaugeFunc struct {
+	name, help string
+	labels     []string
+	fn         func(emit func(v float64, labelValues ...string))
+}
+
+// NewGaugeFunc 创建在输出时取值的gauge
+func NewGaugeFunc(name, help string, labels []string, fn func(emit func(v float64, labelValues ...string))) *GaugeFunc {
+	return &GaugeFunc{name: name, help: help, labels: labels, fn: fn}
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	header(w, g.name, g.help, "gauge")
+	v := vec[float64]{name: g.name, labels: g.labels}
+	g.fn(func(value float64, labelValues ...string) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, v.labelString(strings.Join(labelValues, "\xff")), formatFloat(value))
+	})
+}
+
+// ---------------- histogram ----------------
+
+// DefBuckets 默认的耗时分桶(秒)
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 1800, 3600}
+
+type histogramValue struct {
+	counts []uint64 // 每个桶(不累计)
+	count  uint64
+	sum    float64
+}
+
+// Histogram 分桶统计, 如请求耗时
+type Histogram struct {
+	vec[histogramValue]
+	buckets []float64
+}
+
+// NewHistogram 创建histogram, buckets 需升序
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{vec: newVec[histogramValue](name, help, labels), buckets: buckets}
+}
+
+// Observe 记录一个值
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.get(labelValues, func() *histogramValue {
+		return &histogramValue{counts: make([]uint64, len(h.buckets))}
+	})
+	if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	header(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range h.keys {
+		s := h.values[key]
+		var cum uint64
+		for i, b := range h.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", formatFloat(b)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(key), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(key), s.count)
+	}
+}
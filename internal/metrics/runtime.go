@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+)
+
+// startTime 进程启动时间
+var startTime = time.Now()
+
+// writeRuntime 输出Go运行时指标
+func writeRuntime(w io.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	gauges := []struct {
+		name, help string
+		value      float64
+	}{
+		{"go_goroutines", "当前协程数量", float64(runtime.NumGoroutine())},
+		{"go_threads", "操作系统线程数量", float64(threads())},
+		{"go_memstats_alloc_bytes", "已分配且仍在使用的堆内存", float64(ms.Alloc)},
+		{"go_memstats_heap_inuse_bytes", "使用中的堆内存span", float64(ms.HeapInuse)},
+		{"go_memstats_heap_objects", "已分配的堆对象数量", float64(ms.HeapObjects)},
+		{"go_memstats_sys_bytes", "从操作系统获取的内存", float64(ms.Sys)},
+		{"go_memstats_next_gc_bytes", "下次GC的堆大小", float64(ms.NextGC)},
+		{"go_memstats_last_gc_time_seconds", "上次GC的时间", float64(ms.LastGC) / 1e9},
+		{"process_start_time_seconds", "进程启动时间", float64(startTime.UnixNano()) / 1e9},
+	}
+	for _, g := range gauges {
+		header(w, g.name, g.help, "gauge")
+		fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value))
+	}
+	counters := []struct {
+		name, help string
+		value      float64
+	}{
+		{"go_memstats_alloc_bytes_total", "累计分配的堆内存", float64(ms.TotalAlloc)},
+		{"go_memstats_mallocs_total", "累计分配的堆对象数量", float64(ms.Mallocs)},
+		{"go_gc_cycles_total", "累计GC次数", float64(ms.NumGC)},
+		{"go_gc_pause_seconds_total", "累计GC停顿时间", float64(ms.PauseTotalNs) / 1e9},
+	}
+	for _, c := range counters {
+		header(w, c.name, c.help, "counter")
+		fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.value))
+	}
+	header(w, "go_info", "Go版本", "gauge")
+	fmt.Fprintf(w, "go_info{version=%s} 1\n", quote(runtime.Version()))
+}
+
+func threads() int {
+	n, _ := runtime.ThreadCreateProfile(nil)
+	return n
+}
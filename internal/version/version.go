@@ -0,0 +1,36 @@
+// Package version 构建信息, 由Makefile通过 -ldflags -X 注入
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	Version   = "dev" // 版本号, 如 git describe 的输出
+	Commit    = ""    // git提交
+	BuildTime = ""    // 构建时间
+)
+
+// String 版本信息, 未注入提交时使用go构建时记录的vcs信息
+func String(name string) string {
+	commit, built := Commit, BuildTime
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && commit == "":
+				commit = s.Value
+			case s.Key == "vcs.time" && built == "":
+				built = s.Value
+			}
+		}
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if built == "" {
+		built = "unknown"
+	}
+	return fmt.Sprintf("%s %s (commit %s, built %s, %s %s/%s)", name, Version, commit, built, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}